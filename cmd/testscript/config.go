@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rogpeppe/go-internal/goproxytest"
+	"github.com/rogpeppe/go-internal/gotooltest"
+	"github.com/rogpeppe/go-internal/internal/os/execpath"
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// configName is the name of the configuration file that is looked for
+// in the directory of each script and then in each of its parents.
+const configName = "testscript.conf"
+
+// config holds the settings read from a configuration file.
+type config struct {
+	// file holds the path of the configuration file,
+	// or is empty if none was found.
+	file string
+
+	env      []string // NAME or NAME=value
+	path     []string // absolute directories to add to PATH
+	commands []configProgram
+	conds    []configProgram
+	gotool   bool
+	goproxy  bool
+}
+
+// configProgram describes a command or condition
+// that is implemented by running a program.
+type configProgram struct {
+	name string
+	args []string // the program and any initial arguments
+}
+
+// findConfig returns the configuration for scripts in dir,
+// read from the nearest configuration file in dir or any of
+// its parents. If there is no such file, the default
+// configuration is returned.
+func findConfig(dir string) (*config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		file := filepath.Join(dir, configName)
+		data, err := os.ReadFile(file)
+		if err == nil {
+			return parseConfig(file, data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return &config{gotool: true, goproxy: true}, nil
+		}
+		dir = parent
+	}
+}
+
+// parseConfig parses the contents of the named configuration file.
+// Each line holds a directive followed by its arguments, separated
+// by spaces, except that the argument of env is the rest of the line;
+// blank lines and lines starting with # are ignored.
+func parseConfig(file string, data []byte) (*config, error) {
+	c := &config{
+		file:    file,
+		gotool:  true,
+		goproxy: true,
+	}
+	dir := filepath.Dir(file)
+	// program returns the program named in a directive,
+	// interpreting paths relative to the configuration file.
+	program := func(args []string) []string {
+		if strings.ContainsAny(args[0], `/\`) && !filepath.IsAbs(args[0]) {
+			args[0] = filepath.Join(dir, args[0])
+		}
+		return args
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := strings.Fields(line)
+		errorf := func(format string, a ...any) error {
+			return fmt.Errorf("%s:%d: %s", file, lineno, fmt.Sprintf(format, a...))
+		}
+		switch args[0] {
+		case "env":
+			// The value is the rest of the line,
+			// so that it may contain spaces.
+			v := strings.TrimSpace(line[len("env"):])
+			name, _, _ := strings.Cut(v, "=")
+			if len(args) < 2 || strings.ContainsAny(name, " \t") {
+				return nil, errorf("usage: env NAME[=value]")
+			}
+			switch name {
+			case "":
+				return nil, errorf("invalid variable name %q", name)
+			case "WORK":
+				return nil, errorf("cannot override WORK variable")
+			}
+			c.env = append(c.env, v)
+		case "path":
+			if len(args) != 2 {
+				return nil, errorf("usage: path dir")
+			}
+			p := args[1]
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			c.path = append(c.path, p)
+		case "command", "condition":
+			if len(args) < 3 {
+				return nil, errorf("usage: %s name program [args...]", args[0])
+			}
+			prog := configProgram{
+				name: args[1],
+				args: program(args[2:]),
+			}
+			if args[0] == "command" {
+				c.commands = append(c.commands, prog)
+			} else {
+				c.conds = append(c.conds, prog)
+			}
+		case "gotool", "goproxy":
+			if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+				return nil, errorf("usage: %s on|off", args[0])
+			}
+			if args[0] == "gotool" {
+				c.gotool = args[1] == "on"
+			} else {
+				c.goproxy = args[1] == "on"
+			}
+		default:
+			return nil, errorf("unknown directive %q", args[0])
+		}
+	}
+	return c, scanner.Err()
+}
+
+// apply configures p according to c.
+func (c *config) apply(p *testscript.Params) error {
+	if c.gotool {
+		if _, err := exec.LookPath("go"); err == nil {
+			if err := gotooltest.Setup(p); err != nil {
+				return fmt.Errorf("failed to setup go tool: %v", err)
+			}
+		}
+	}
+	if c.goproxy {
+		goproxytest.Setup(p)
+	}
+	if len(c.commands) > 0 && p.Commands == nil {
+		p.Commands = make(map[string]testscript.Cmd)
+	}
+	for _, prog := range c.commands {
+		p.Commands[prog.name] = testscript.Cmd{
+			Run:       prog.runCmd,
+			Summary:   fmt.Sprintf("Run %s, as configured in %s.", strings.Join(prog.args, " "), c.file),
+			Negatable: true,
+		}
+	}
+	if len(c.conds) > 0 && p.Conditions == nil {
+		p.Conditions = make(map[string]testscript.Cond)
+	}
+	for _, prog := range c.conds {
+		p.Conditions[prog.name] = testscript.Cond{
+			Eval:    c.probe(prog),
+			Summary: fmt.Sprintf("%s succeeds, as configured in %s", strings.Join(prog.args, " "), c.file),
+		}
+	}
+	origSetup := p.Setup
+	p.Setup = func(env *testscript.Env) error {
+		if origSetup != nil {
+			if err := origSetup(env); err != nil {
+				return err
+			}
+		}
+		for _, v := range c.env {
+			if !strings.Contains(v, "=") {
+				v += "=" + os.Getenv(v)
+			}
+			env.Vars = append(env.Vars, v)
+		}
+		if len(c.path) > 0 {
+			env.Setenv("PATH", c.pathList(env.Getenv("PATH")))
+		}
+		return nil
+	}
+	return nil
+}
+
+// pathList returns the PATH value formed by adding
+// the configured directories to the front of path.
+func (c *config) pathList(path string) string {
+	return strings.Join(append(c.path[:len(c.path):len(c.path)], path), string(filepath.ListSeparator))
+}
+
+// runCmd runs the program as a script command.
+func (prog configProgram) runCmd(ts *testscript.TestScript, neg bool, args []string) {
+	err := ts.Exec(prog.args[0], slices.Concat(prog.args[1:], args)...)
+	if neg {
+		if err == nil {
+			ts.Fatalf("unexpected %s command success", prog.name)
+		}
+		return
+	}
+	ts.Check(err)
+}
+
+// probe returns a condition that is satisfied when the program exits
+// successfully. The program is run directly rather than through a
+// shell, in the directory containing the configuration file and the
+// environment of the testscript command with the configured PATH, and
+// its result is remembered. Unlike a command, it is not run in the
+// directory of any one script, as its result is shared by all of them.
+func (c *config) probe(prog configProgram) func(ts *testscript.TestScript, suffix string) (bool, error) {
+	var (
+		once   sync.Once
+		result bool
+		err    error
+	)
+	return func(ts *testscript.TestScript, suffix string) (bool, error) {
+		once.Do(func() {
+			env := os.Environ()
+			if len(c.path) > 0 {
+				env = append(env, "PATH="+c.pathList(os.Getenv("PATH")))
+			}
+			getenv := func(k string) string {
+				if strings.EqualFold(k, "PATH") && len(c.path) > 0 {
+					return c.pathList(os.Getenv(k))
+				}
+				return os.Getenv(k)
+			}
+			var path string
+			path, err = execpath.Look(prog.args[0], getenv)
+			if err != nil {
+				err = fmt.Errorf("condition %s: %v", prog.name, err)
+				return
+			}
+			cmd := exec.Command(path, prog.args[1:]...)
+			cmd.Dir = filepath.Dir(c.file)
+			cmd.Env = env
+			result = cmd.Run() == nil
+		})
+		return result, err
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// debugger implements the -debug flag, pausing scripts
+// so that they can be stepped through interactively.
+type debugger struct {
+	in  *bufio.Scanner
+	out io.Writer
+
+	// mode says when to pause next.
+	mode debugMode
+	// untilLine holds the line to run to in debugUntilLine mode.
+	untilLine int
+}
+
+type debugMode int
+
+const (
+	debugStepMode  debugMode = iota // pause before every statement
+	debugNextPhase                  // pause at the start of the next phase
+	debugUntilLine                  // pause at untilLine
+	debugContinue                   // only pause on failure
+)
+
+func newDebugger(in io.Reader, out io.Writer) *debugger {
+	return &debugger{
+		in:  bufio.NewScanner(in),
+		out: out,
+	}
+}
+
+const debugHelp = `Commands:
+    s, step           run the next statement (also an empty line)
+    n, next           run to the start of the next phase
+    u, until LINE     run to the given line
+    c, continue       run to the end of the script, stopping only on failure
+    env [NAME...]     print the script environment, or the named variables
+    stdout, stderr    print the output of the last command
+    bg                list the background commands
+    shell             open a shell in the current directory of the script
+    h, help           print this help
+`
+
+// event is used as testscript.Params.Debug.
+func (d *debugger) event(ts *testscript.TestScript, ev testscript.DebugEvent) {
+	switch ev.Kind {
+	case testscript.DebugPhase:
+		if d.mode == debugNextPhase {
+			d.mode = debugStepMode
+		}
+		if d.mode != debugStepMode {
+			return
+		}
+	case testscript.DebugStep:
+		if d.mode == debugUntilLine && ev.Line == d.untilLine {
+			d.mode = debugStepMode
+		}
+		if d.mode != debugStepMode {
+			return
+		}
+	case testscript.DebugFail:
+		fmt.Fprintf(d.out, "%s", ev.Output)
+		fmt.Fprintf(d.out, "%s:%d: script failed; starting a shell in the script environment.\n", ev.File, ev.Line)
+		fmt.Fprintf(d.out, "Exit the shell to continue.\n")
+		d.shell(ts)
+		return
+	}
+	fmt.Fprintf(d.out, "%s:%d: %s\n", ev.File, ev.Line, strings.TrimSpace(ev.Text))
+	d.prompt(ts)
+}
+
+// prompt reads and runs debugger commands until one of them
+// resumes the script.
+func (d *debugger) prompt(ts *testscript.TestScript) {
+	for {
+		fmt.Fprintf(d.out, "(debug) ")
+		if !d.in.Scan() {
+			// No more input; let the script run to completion.
+			fmt.Fprintln(d.out)
+			d.mode = debugContinue
+			return
+		}
+		args := strings.Fields(d.in.Text())
+		if len(args) == 0 {
+			args = []string{"step"}
+		}
+		switch args[0] {
+		case "s", "step":
+			d.mode = debugStepMode
+			return
+		case "n", "next":
+			d.mode = debugNextPhase
+			return
+		case "u", "until":
+			line := 0
+			if len(args) == 2 {
+				line, _ = strconv.Atoi(args[1])
+			}
+			if line <= 0 {
+				fmt.Fprintf(d.out, "usage: until LINE\n")
+				continue
+			}
+			d.mode = debugUntilLine
+			d.untilLine = line
+			return
+		case "c", "continue":
+			d.mode = debugContinue
+			return
+		case "env":
+			for _, kv := range ts.Environ() {
+				name, _, _ := strings.Cut(kv, "=")
+				if len(args) == 1 || slices.Contains(args[1:], name) {
+					fmt.Fprintln(d.out, kv)
+				}
+			}
+		case "stdout", "stderr":
+			fmt.Fprint(d.out, ts.ReadFile(args[0]))
+		case "bg":
+			for _, cmd := range ts.BackgroundCmds() {
+				state := "running"
+				if cmd.ProcessState != nil {
+					state = cmd.ProcessState.String()
+				}
+				fmt.Fprintf(d.out, "%d\t%s\t%s\n", cmd.Process.Pid, state, strings.Join(cmd.Args, " "))
+			}
+		case "shell":
+			d.shell(ts)
+		case "h", "help":
+			fmt.Fprint(d.out, debugHelp)
+		default:
+			fmt.Fprintf(d.out, "unknown command %q; type help for a list of commands\n", args[0])
+		}
+	}
+}
+
+// shell runs an interactive shell in the current directory
+// of the script, with the script's environment.
+func (d *debugger) shell(ts *testscript.TestScript) {
+	sh := os.Getenv("SHELL")
+	if runtime.GOOS == "windows" {
+		sh = os.Getenv("ComSpec")
+	}
+	if sh == "" {
+		sh = "/bin/sh"
+	}
+	cmd := exec.Command(sh)
+	cmd.Dir = ts.MkAbs(".")
+	cmd.Env = ts.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(d.out, "shell: %v\n", err)
+	}
+}
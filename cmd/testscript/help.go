@@ -14,14 +14,27 @@ The testscript command runs github.com/rogpeppe/go-internal/testscript scripts
 in a fresh temporary work directory tree.
 
 Usage:
-    testscript [-v] [-e VAR[=value]]... [-u] [-continue] [-work] files...
+    testscript [-v] [-e VAR[=value]]... [-cmd name=path]... [-u] [-continue] [-work] [-run regexp] [-count n] [-json] [-junit file]
+        [-watch [-watchpath path]...] [-debug] files...
+    testscript -doc
+    testscript -lsp
 
 The testscript command is designed to make it easy to create self-contained
 reproductions of command sequences.
 
 Each file is opened as a script and run as described in the documentation for
 github.com/rogpeppe/go-internal/testscript. The special filename "-" is
-interpreted as the standard input.
+interpreted as the standard input. A directory argument stands for all the
+files with a .txtar or .txt suffix in the directory, and a directory followed by
+"/..." (for example "testdata/...") also includes those in its subdirectories,
+apart from hidden directories whose names begin with ".".
+
+The -run flag runs only the scripts whose names match the given regular
+expression, where the name of a script is its file name without the .txtar or
+.txt suffix. The -count flag runs each script the given number of times.
+
+When more than one script is run, a table of the results is printed to the
+standard error once they have all finished, with the slowest scripts first.
 
 As a special case, supporting files/directories in the .gomodproxy subdirectory
 will be served via a github.com/rogpeppe/go-internal/goproxytest server which
@@ -36,9 +49,53 @@ where VAR is the name of the variable. Variables override testscript-defined
 values, with the exception of WORK which cannot be overridden. The -e flag can
 appear multiple times to specify multiple variables.
 
+Each script is configured by the nearest file named testscript.conf in the
+directory containing the script or in one of its parents; the script read from
+the standard input uses the configuration for the current directory, as does
+-doc. Each line of the file holds one of the following directives, and blank
+lines and lines beginning with "#" are ignored:
+
+    env NAME[=value]
+        Set the environment variable NAME in each script, passing its
+        value through from the testscript command if no value is given,
+        as with the -e flag. The value is the rest of the line, and may
+        contain spaces. Variables given with -e take precedence.
+    path dir
+        Add dir, interpreted relative to the directory containing the
+        configuration file, to the front of PATH in each script.
+    command name program [args...]
+        Make the program available to scripts as a command called name,
+        which runs the program with the given arguments followed by those
+        of the command, as for exec, in the script's current directory.
+    condition name program [args...]
+        Define the condition [name], which is satisfied if the program
+        exits successfully when run with the given arguments. The program
+        is run directly rather than through a shell, at most once per run,
+        in the directory containing the configuration file.
+    gotool on|off
+        Whether to make the go command available to scripts, as described
+        for github.com/rogpeppe/go-internal/gotooltest (on by default).
+    goproxy on|off
+        Whether to serve the .gomodproxy directory as described above
+        (on by default).
+
+A program containing a path separator is interpreted relative to the
+directory containing the configuration file; otherwise it is looked up in
+PATH, including any directories added with the path directive.
+
+The -cmd flag makes the program at the given path available to each script
+as a command with the given name, as if it had been registered with
+testscript.Main: the program is copied into a directory that is added to the
+front of PATH, so that "name args..." and "exec name args..." both run it. It
+can appear multiple times to add several programs, and is the command line
+equivalent of testscript.Params.Executables.
+
 The -u flag specifies that if a cmp command within a testscript fails and its
 second argument refers to a file inside the testscript file, the command will
 succeed and the testscript file will be updated to reflect the actual content.
+If the second argument refers to a file that does not exist, it is added to the
+testscript file, or, if it is outside $WORK (for example in $SCRIPTDIR, the
+directory containing the script), written directly.
 As such, this is the cmd/testcript equivalent of
 testscript.Params.UpdateScripts.
 
@@ -48,6 +105,49 @@ All errors will be printed and the exit status will be false.
 The -work flag prints the temporary work directory path before running each
 script, and does not remove that directory when testscript exits.
 
+The -json flag prints the results as a stream of JSON events, in the same
+format as "go test -json" (see "go doc test2json"), instead of printing the
+script logs directly. Each script is reported as a test named after the script
+file, within a package named "testscript".
+
+The -junit flag writes a JUnit XML report to the named file once all the
+scripts have run, with the status and duration of each script, and its log
+when it fails or is skipped. It can be combined with -json.
+
+The -watch flag runs the scripts and then keeps polling the script files,
+rerunning a script whenever its file changes. Each run clears the screen and
+ends with a summary of which scripts passed and failed. The -watchpath flag
+names another file to poll, such as a binary under test, and can appear
+multiple times; when it changes, all the scripts are rerun. A -watchpath
+argument that is not an existing file and contains no path separator is looked
+up in $PATH. Stop watching by interrupting the command.
+
+The -debug flag steps through the scripts interactively. Before each statement
+and at the start of each phase, testscript prints the position of the statement
+and prompts for a command: "step" (or an empty line) runs the statement, "next"
+runs to the start of the next phase, "until LINE" runs to the given line and
+"continue" runs to the end of the script. The "env", "stdout", "stderr" and
+"bg" commands print the script environment, the output of the last command and
+the background commands, and "shell" starts $SHELL in the current directory of
+the script with the script environment. When a statement fails, a shell is
+started in the same way before any cleanup happens, so that the state of the
+script can be examined; exit the shell to let the script finish.
+
+The -doc flag prints reference documentation for all the commands and
+conditions available to scripts, including the go command when it is
+available, and exits without running any scripts.
+
+The -lsp flag runs a language server for script files, speaking the Language
+Server Protocol on the standard input and output, for use by editors. It
+reports errors in the script section of an open file as it is edited, such as
+unknown commands and conditions, wrong numbers of arguments and unbalanced if
+blocks; it completes command and condition names and archive file names, shows
+the documentation of the command or condition under the cursor, and goes from
+a file name argument to its "-- name --" section in the archive. The "Run
+script" code action runs the saved file with testscript and marks the line on
+which it failed. Commands and conditions are configured by testscript.conf
+files as when running scripts.
+
 Examples
 ========
 
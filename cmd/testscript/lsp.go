@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/rogpeppe/go-internal/imports"
+	"github.com/rogpeppe/go-internal/testscript"
+	"github.com/rogpeppe/go-internal/txtar"
+)
+
+// lspServer implements a language server for testscript files,
+// as started by the -lsp flag. Only the parts of the Language
+// Server Protocol needed for diagnostics, completion, hover,
+// go-to-definition and running scripts are supported.
+type lspServer struct {
+	in *bufio.Reader
+
+	outMu sync.Mutex
+	out   io.Writer
+
+	mu   sync.Mutex
+	docs map[string]string // open documents, keyed by URI
+	// params caches the parameters for scripts, keyed by
+	// configuration file.
+	params map[string]cachedParams
+
+	// runs tracks the scripts started by executeCommand
+	// that are still running.
+	runs sync.WaitGroup
+
+	// runScript runs the script file at path,
+	// returning its combined output.
+	runScript func(path string) ([]byte, error)
+}
+
+// cachedParams holds the parameters configured by a configuration
+// file, along with the modification time of the file when they were
+// read, so that they are read again when the file changes.
+type cachedParams struct {
+	modTime time.Time
+	p       *testscript.Params
+}
+
+// runCommand is the command used by the "Run script" code action.
+const runCommand = "testscript.run"
+
+func newLSPServer(in io.Reader, out io.Writer) *lspServer {
+	return &lspServer{
+		in:     bufio.NewReader(in),
+		out:    out,
+		docs:   make(map[string]string),
+		params: make(map[string]cachedParams),
+		runScript: func(path string) ([]byte, error) {
+			exe, err := os.Executable()
+			if err != nil {
+				return nil, err
+			}
+			cmd := exec.Command(exe, filepath.Base(path))
+			cmd.Dir = filepath.Dir(path)
+			return cmd.CombinedOutput()
+		},
+	}
+}
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type rpcErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   rpcError        `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// errMethodNotFound is returned for requests that are not supported.
+var errMethodNotFound = errors.New("method not found")
+
+// serve reads and handles messages until the client asks the
+// server to exit or the input is closed.
+func (s *lspServer) serve() error {
+	for {
+		req, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			// A notification, which gets no reply.
+			continue
+		}
+		if err != nil {
+			code := -32603 // InternalError
+			if err == errMethodNotFound {
+				code = -32601 // MethodNotFound
+			}
+			s.write(rpcErrorResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcError{Code: code, Message: err.Error()}})
+			continue
+		}
+		s.write(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+	}
+}
+
+// read reads a single message with its Content-Length header.
+func (s *lspServer) read() (*rpcRequest, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && length == -1 {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", v)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.in, data); err != nil {
+		return nil, err
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return &req, nil
+}
+
+// write writes a single message with its Content-Length header.
+func (s *lspServer) write(msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// Protocol types, with only the fields that are used.
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspCompletionItem struct {
+	Label         string         `json:"label"`
+	Kind          int            `json:"kind"`
+	Detail        string         `json:"detail,omitempty"`
+	Documentation *lspMarkupText `json:"documentation,omitempty"`
+}
+
+type lspMarkupText struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspCommand struct {
+	Title     string `json:"title"`
+	Command   string `json:"command"`
+	Arguments []any  `json:"arguments,omitempty"`
+}
+
+// Completion item kinds.
+const (
+	completionFunction = 3
+	completionKeyword  = 14
+	completionValue    = 12
+	completionFile     = 17
+)
+
+// Diagnostic severities.
+const (
+	severityError = 1
+)
+
+func (s *lspServer) handle(req *rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": 1, // full document sync
+				"completionProvider": map[string]any{
+					"triggerCharacters": []string{"["},
+				},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"codeActionProvider": true,
+				"executeCommandProvider": map[string]any{
+					"commands": []string{runCommand},
+				},
+			},
+			"serverInfo": map[string]any{
+				"name": "testscript",
+			},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.setDoc(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.setDoc(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		delete(s.docs, params.TextDocument.URI)
+		s.mu.Unlock()
+		s.publish(params.TextDocument.URI, nil)
+		return nil, nil
+	case "textDocument/completion":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params.TextDocument.URI, params.Position), nil
+	case "textDocument/hover":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params.TextDocument.URI, params.Position), nil
+	case "textDocument/definition":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params.TextDocument.URI, params.Position), nil
+	case "textDocument/codeAction":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return []any{
+			map[string]any{
+				"title": "Run script",
+				"kind":  "source",
+				"command": lspCommand{
+					Title:     "Run script",
+					Command:   runCommand,
+					Arguments: []any{params.TextDocument.URI},
+				},
+			},
+		}, nil
+	case "workspace/executeCommand":
+		var params struct {
+			Command   string            `json:"command"`
+			Arguments []json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if params.Command != runCommand || len(params.Arguments) != 1 {
+			return nil, fmt.Errorf("unknown command %q", params.Command)
+		}
+		var uri string
+		if err := json.Unmarshal(params.Arguments[0], &uri); err != nil {
+			return nil, err
+		}
+		path, ok := uriToPath(uri)
+		if !ok {
+			return nil, fmt.Errorf("cannot run %s: not a file", uri)
+		}
+		// Run the script in the background so that the server
+		// keeps answering requests while it runs.
+		s.runs.Add(1)
+		go func() {
+			defer s.runs.Done()
+			s.run(uri, path)
+		}()
+		return nil, nil
+	}
+	if req.ID == nil || strings.HasPrefix(req.Method, "$/") {
+		// Ignore notifications that we do not support.
+		return nil, nil
+	}
+	return nil, errMethodNotFound
+}
+
+// setDoc records the text of the document and publishes
+// diagnostics for it.
+func (s *lspServer) setDoc(uri, text string) {
+	s.mu.Lock()
+	s.docs[uri] = text
+	s.mu.Unlock()
+	s.publish(uri, s.check(uri, text))
+}
+
+func (s *lspServer) doc(uri string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text, ok := s.docs[uri]
+	return text, ok
+}
+
+func (s *lspServer) publish(uri string, diags []lspDiagnostic) {
+	if diags == nil {
+		diags = []lspDiagnostic{}
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]any{
+		"uri":         uri,
+		"diagnostics": diags,
+	})
+}
+
+// check returns diagnostics for the script in the document.
+func (s *lspServer) check(uri, text string) []lspDiagnostic {
+	p, err := s.paramsFor(uri)
+	if err != nil {
+		return []lspDiagnostic{lineDiagnostic(text, 0, err.Error())}
+	}
+	script := string(txtar.Parse([]byte(text)).Comment)
+	var diags []lspDiagnostic
+	for _, e := range p.CheckScript(script) {
+		diags = append(diags, lineDiagnostic(text, e.Line-1, e.Msg))
+	}
+	return diags
+}
+
+// lineDiagnostic returns an error diagnostic covering
+// the given zero-based line of text.
+func lineDiagnostic(text string, line int, msg string) lspDiagnostic {
+	lines := strings.Split(text, "\n")
+	end := 0
+	if line < len(lines) {
+		end = utf16Len(strings.TrimRight(lines[line], "\r"))
+	}
+	return lspDiagnostic{
+		Range: lspRange{
+			Start: lspPosition{Line: line},
+			End:   lspPosition{Line: line, Character: end},
+		},
+		Severity: severityError,
+		Source:   "testscript",
+		Message:  msg,
+	}
+}
+
+// paramsFor returns the parameters used to run the script in the
+// document, configured by any testscript.conf file as when the
+// script is run by the testscript command.
+func (s *lspServer) paramsFor(uri string) (*testscript.Params, error) {
+	dir := "."
+	if path, ok := uriToPath(uri); ok {
+		dir = filepath.Dir(path)
+	}
+	cfg, err := findConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	var modTime time.Time
+	if cfg.file != "" {
+		info, err := os.Stat(cfg.file)
+		if err != nil {
+			return nil, err
+		}
+		modTime = info.ModTime()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.params[cfg.file]; ok && c.modTime.Equal(modTime) {
+		return c.p, nil
+	}
+	p := new(testscript.Params)
+	if err := cfg.apply(p); err != nil {
+		return nil, err
+	}
+	s.params[cfg.file] = cachedParams{modTime: modTime, p: p}
+	return p, nil
+}
+
+// scriptWord holds a word on a script line.
+type scriptWord struct {
+	start, end int // byte offsets within the line
+	text       string
+}
+
+// wordRole says how a word is used on a script line.
+type wordRole int
+
+const (
+	roleArg wordRole = iota
+	roleCommand
+	roleCond
+)
+
+// lineWords splits a script line into words, treating quoted text as
+// part of the word containing it, and stopping at a comment. It also
+// returns the role of each word.
+func lineWords(line string) ([]scriptWord, []wordRole) {
+	var words []scriptWord
+	start := -1
+	quoted := false
+	for i := 0; i <= len(line); i++ {
+		if i == len(line) || (!quoted && (line[i] == ' ' || line[i] == '\t' || line[i] == '#')) {
+			if start >= 0 {
+				words = append(words, scriptWord{start, i, line[start:i]})
+				start = -1
+			}
+			if i < len(line) && line[i] == '#' {
+				break
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		if line[i] == '\'' {
+			quoted = !quoted
+		}
+	}
+	roles := make([]wordRole, len(words))
+	inCond := false
+	sawCommand := false
+	for i, w := range words {
+		switch {
+		case sawCommand:
+			roles[i] = roleArg
+		case inCond || strings.HasPrefix(w.text, "["):
+			roles[i] = roleCond
+			inCond = !strings.HasSuffix(w.text, "]")
+		case w.text == "!":
+			roles[i] = roleArg
+		default:
+			roles[i] = roleCommand
+			sawCommand = true
+			if w.text == "if" {
+				// The condition of an if block follows the keyword.
+				sawCommand = false
+			}
+		}
+	}
+	return words, roles
+}
+
+// scriptLine returns the given line of the document, and whether
+// the line is within the script rather than one of its files.
+func scriptLine(text string, line int) (string, bool) {
+	lines := strings.Split(text, "\n")
+	if ar := txtar.Parse([]byte(text)); len(ar.Files) > 0 {
+		// The first file marker follows the script.
+		lines = lines[:strings.Count(string(ar.Comment), "\n")]
+	}
+	if line < 0 || line >= len(lines) {
+		return "", false
+	}
+	return strings.TrimSuffix(lines[line], "\r"), true
+}
+
+// wordAt returns the index of the word containing, or ending at,
+// the byte offset.
+func wordAt(words []scriptWord, off int) int {
+	for i, w := range words {
+		if off >= w.start && off <= w.end {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *lspServer) completion(uri string, pos lspPosition) []lspCompletionItem {
+	text, ok := s.doc(uri)
+	if !ok {
+		return nil
+	}
+	line, ok := scriptLine(text, pos.Line)
+	if !ok {
+		return nil
+	}
+	p, err := s.paramsFor(uri)
+	if err != nil {
+		return nil
+	}
+	off := byteOffset(line, pos.Character)
+	// Add a character at the cursor so that there is always
+	// a word there, even when starting a new one.
+	words, roles := lineWords(line[:off] + "x")
+	role := roleArg
+	if i := wordAt(words, off+1); i >= 0 {
+		role = roles[i]
+	}
+	var items []lspCompletionItem
+	switch role {
+	case roleCommand:
+		cmds := p.AllCmds()
+		for _, name := range slices.Sorted(maps.Keys(cmds)) {
+			c := cmds[name]
+			items = append(items, lspCompletionItem{
+				Label:         name,
+				Kind:          completionFunction,
+				Detail:        c.Synopsis(name),
+				Documentation: &lspMarkupText{Kind: "plaintext", Value: c.Doc(name)},
+			})
+		}
+		for _, kw := range []string{"if", "else", "end", "retry"} {
+			items = append(items, lspCompletionItem{Label: kw, Kind: completionKeyword})
+		}
+	case roleCond:
+		conds := p.AllConds()
+		for _, name := range slices.Sorted(maps.Keys(conds)) {
+			items = append(items, lspCompletionItem{
+				Label:         name,
+				Kind:          completionValue,
+				Documentation: &lspMarkupText{Kind: "plaintext", Value: conds[name].Doc(name)},
+			})
+		}
+	case roleArg:
+		for _, f := range txtar.Parse([]byte(text)).Files {
+			items = append(items, lspCompletionItem{Label: f.Name, Kind: completionFile})
+		}
+	}
+	return items
+}
+
+func (s *lspServer) hover(uri string, pos lspPosition) any {
+	text, ok := s.doc(uri)
+	if !ok {
+		return nil
+	}
+	line, ok := scriptLine(text, pos.Line)
+	if !ok {
+		return nil
+	}
+	p, err := s.paramsFor(uri)
+	if err != nil {
+		return nil
+	}
+	off := byteOffset(line, pos.Character)
+	words, roles := lineWords(line)
+	i := wordAt(words, off)
+	if i < 0 {
+		return nil
+	}
+	w := words[i]
+	var doc string
+	switch roles[i] {
+	case roleCommand:
+		if c, ok := p.AllCmds()[w.text]; ok {
+			doc = c.Doc(w.text)
+		}
+	case roleCond:
+		// Find the condition name around the offset.
+		isNameByte := func(c byte) bool {
+			return c != '[' && c != ']' && c != '!' && c != '&' && c != '|' && c != '(' && c != ')' && c != ' '
+		}
+		start, end := off, off
+		for start > w.start && isNameByte(line[start-1]) {
+			start--
+		}
+		for end < w.end && isNameByte(line[end]) {
+			end++
+		}
+		if start == end {
+			return nil
+		}
+		doc = condDoc(p, line[start:end])
+		w = scriptWord{start, end, line[start:end]}
+	}
+	if doc == "" {
+		return nil
+	}
+	return map[string]any{
+		"contents": lspMarkupText{Kind: "markdown", Value: "```\n" + doc + "```"},
+		"range": lspRange{
+			Start: lspPosition{Line: pos.Line, Character: utf16Len(line[:w.start])},
+			End:   lspPosition{Line: pos.Line, Character: utf16Len(line[:w.end])},
+		},
+	}
+}
+
+// condDoc returns the documentation for the named condition.
+func condDoc(p *testscript.Params, name string) string {
+	conds := p.AllConds()
+	switch {
+	case imports.KnownOS[name]:
+		name = "GOOS"
+	case imports.KnownArch[name]:
+		name = "GOARCH"
+	case strings.HasPrefix(name, "go1."):
+		name = "go1.x"
+	}
+	if c, ok := conds[name]; ok {
+		return c.Doc(name)
+	}
+	if prefix, _, ok := strings.Cut(name, ":"); ok {
+		if c, ok := conds[prefix+":"]; ok {
+			return c.Doc(prefix + ":")
+		}
+	}
+	return ""
+}
+
+func (s *lspServer) definition(uri string, pos lspPosition) any {
+	text, ok := s.doc(uri)
+	if !ok {
+		return nil
+	}
+	line, ok := scriptLine(text, pos.Line)
+	if !ok {
+		return nil
+	}
+	words, _ := lineWords(line)
+	i := wordAt(words, byteOffset(line, pos.Character))
+	if i < 0 {
+		return nil
+	}
+	name := strings.ReplaceAll(words[i].text, "'", "")
+	name = strings.TrimPrefix(name, "$WORK/")
+	for n, l := range strings.Split(text, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.HasPrefix(l, "-- ") && strings.HasSuffix(l, " --") && strings.TrimSpace(l[3:len(l)-3]) == name {
+			return lspLocation{
+				URI: uri,
+				Range: lspRange{
+					Start: lspPosition{Line: n},
+					End:   lspPosition{Line: n, Character: utf16Len(l)},
+				},
+			}
+		}
+	}
+	return nil
+}
+
+// failRegexp matches the line of testscript output
+// that reports why a script failed.
+var failRegexp = regexp.MustCompile(`(?m)^FAIL: .*:(\d+): (.*)$`)
+
+// run runs the saved script file at path for the document with
+// the given URI, publishing a diagnostic for the line on which it
+// fails and showing the result of the run.
+func (s *lspServer) run(uri, path string) {
+	out, runErr := s.runScript(path)
+	text, ok := s.doc(uri)
+	if !ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			s.notify("window/showMessage", map[string]any{
+				"type":    1, // Error
+				"message": err.Error(),
+			})
+			return
+		}
+		text = string(data)
+	}
+	diags := s.check(uri, text)
+	msg := "PASS: " + filepath.Base(path)
+	msgType := 3 // Info
+	if runErr != nil {
+		msg = fmt.Sprintf("FAIL: %s: %v", filepath.Base(path), runErr)
+		msgType = 1 // Error
+		if m := failRegexp.FindSubmatch(out); m != nil {
+			line, _ := strconv.Atoi(string(m[1]))
+			diags = append(diags, lineDiagnostic(text, line-1, string(m[2])+"\n\n"+string(out)))
+			msg = fmt.Sprintf("FAIL: %s:%s: %s", filepath.Base(path), m[1], m[2])
+		}
+	}
+	s.publish(uri, diags)
+	s.notify("window/showMessage", map[string]any{
+		"type":    msgType,
+		"message": msg,
+	})
+}
+
+// uriToPath returns the file path for a file URI.
+func uriToPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		path = strings.TrimPrefix(path, "/")
+	}
+	return filepath.FromSlash(path), true
+}
+
+// utf16Len returns the length of s in UTF-16 code units,
+// as used for character offsets by the protocol.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// byteOffset returns the byte offset within line of the
+// given character offset, counted in UTF-16 code units.
+func byteOffset(line string, char int) int {
+	n := 0
+	for i, r := range line {
+		if n >= char {
+			return i
+		}
+		n += utf16.RuneLen(r)
+	}
+	return len(line)
+}
@@ -10,12 +10,13 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync/atomic"
+	"time"
 
-	"github.com/rogpeppe/go-internal/goproxytest"
-	"github.com/rogpeppe/go-internal/gotooltest"
 	"github.com/rogpeppe/go-internal/testscript"
 )
 
@@ -32,6 +33,19 @@ func (e *envVarsFlag) Set(v string) error {
 	return nil
 }
 
+// stringsFlag is a flag that can appear multiple times,
+// collecting each of its values in order.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func main() {
 	switch err := mainerr(); err {
 	case nil:
@@ -51,13 +65,61 @@ func mainerr() (retErr error) {
 	fWork := flag.Bool("work", false, "print temporary work directory and do not remove when done")
 	fContinue := flag.Bool("continue", false, "continue running the script if an error occurs")
 	fVerbose := flag.Bool("v", false, "run tests verbosely")
+	fDoc := flag.Bool("doc", false, "print documentation for the commands and conditions available to scripts")
+	fJSON := flag.Bool("json", false, "print results as JSON events in the format used by go test -json")
+	fJUnit := flag.String("junit", "", "write a JUnit XML report of the results to `file`")
+	fDebug := flag.Bool("debug", false, "step through scripts interactively, starting a shell on failure")
+	fRun := flag.String("run", "", "run only the scripts whose names match `regexp`")
+	fCount := flag.Int("count", 1, "run each script `n` times")
+	fWatch := flag.Bool("watch", false, "rerun scripts when they or any -watchpath files change")
+	fLSP := flag.Bool("lsp", false, "run a language server for script files on stdin and stdout")
+	var watchPaths, cmds stringsFlag
+	flag.Var(&cmds, "cmd", "make the program at `path` available to scripts as a command (name=path; can appear multiple times)")
 	flag.Var(&envVars, "e", "pass through environment variable to script (can appear multiple times)")
+	flag.Var(&watchPaths, "watchpath", "with -watch, also rerun all scripts when `path` changes (can appear multiple times)")
 	flag.Parse()
 
+	if *fLSP {
+		if flag.NArg() > 0 {
+			return fmt.Errorf("cannot use -lsp with script arguments")
+		}
+		return newLSPServer(os.Stdin, os.Stdout).serve()
+	}
+	if *fDoc {
+		var p testscript.Params
+		cfg, err := findConfig(".")
+		if err != nil {
+			return err
+		}
+		if err := cfg.apply(&p); err != nil {
+			return err
+		}
+		return p.WriteReference(os.Stdout)
+	}
+
+	var runRegexp *regexp.Regexp
+	if *fRun != "" {
+		re, err := regexp.Compile(*fRun)
+		if err != nil {
+			return fmt.Errorf("invalid -run regexp: %v", err)
+		}
+		runRegexp = re
+	}
+	if *fCount < 1 {
+		return fmt.Errorf("invalid -count %d", *fCount)
+	}
 	files := flag.Args()
 	if len(files) == 0 {
 		files = []string{"-"}
 	}
+	files, err := expandScripts(files, runRegexp)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "testscript: no scripts to run")
+		return nil
+	}
 
 	// If we are only reading from stdin, -u cannot be specified. It seems a bit
 	// bizarre to invoke testscript with '-' and a regular file, but hey. In
@@ -72,6 +134,18 @@ func mainerr() (retErr error) {
 	if onlyReadFromStdin && *fUpdate {
 		return fmt.Errorf("cannot use -u when reading from stdin")
 	}
+	if *fWatch && slices.Contains(files, "-") {
+		return fmt.Errorf("cannot use -watch when reading from stdin")
+	}
+	if *fWatch && *fJSON {
+		return fmt.Errorf("cannot use -watch with -json")
+	}
+	if *fDebug && slices.Contains(files, "-") {
+		return fmt.Errorf("cannot use -debug when reading from stdin")
+	}
+	if *fDebug && *fJSON {
+		return fmt.Errorf("cannot use -debug with -json")
+	}
 	var stdinTempFile string
 	for i, f := range files {
 		if f != "-" {
@@ -99,52 +173,130 @@ func mainerr() (retErr error) {
 		defer os.Remove(stdinTempFile)
 	}
 
-	p := testscript.Params{
-		Setup:           func(*testscript.Env) error { return nil },
-		Files:           files,
+	baseParams := testscript.Params{
 		UpdateScripts:   *fUpdate,
 		ContinueOnError: *fContinue,
 		TestWork:        *fWork,
 	}
-
-	if _, err := exec.LookPath("go"); err == nil {
-		if err := gotooltest.Setup(&p); err != nil {
-			return fmt.Errorf("failed to setup go tool: %v", err)
+	if *fDebug {
+		baseParams.Debug = newDebugger(os.Stdin, os.Stdout).event
+	}
+	for _, c := range cmds {
+		name, path, ok := strings.Cut(c, "=")
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("invalid -cmd %q; want name=path", c)
 		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if baseParams.Executables == nil {
+			baseParams.Executables = make(map[string]string)
+		}
+		baseParams.Executables[name] = path
 	}
-	goproxytest.Setup(&p)
-	origSetup := p.Setup
-	p.Setup = func(env *testscript.Env) error {
-		if err := origSetup(env); err != nil {
+
+	// Scripts are run in groups that share the same configuration file.
+	// The script read from stdin uses the configuration for the current
+	// directory.
+	var groups []testscript.Params
+	groupOf := make(map[string]int)
+	configGroups := make(map[string]int)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if file == stdinTempFile {
+			dir = "."
+		}
+		cfg, err := findConfig(dir)
+		if err != nil {
 			return err
 		}
-		if *fWork {
-			env.T().Log("temporary work directory: ", env.WorkDir)
+		if i, ok := configGroups[cfg.file]; ok {
+			groupOf[file] = i
+			continue
 		}
-		for _, v := range envVars.vals {
-			varName, _, ok := strings.Cut(v, "=")
-			if !ok {
-				v += "=" + os.Getenv(v)
+		p := baseParams
+		if err := cfg.apply(&p); err != nil {
+			return err
+		}
+		origSetup := p.Setup
+		p.Setup = func(env *testscript.Env) error {
+			if err := origSetup(env); err != nil {
+				return err
+			}
+			if *fWork {
+				env.T().Log("temporary work directory: ", env.WorkDir)
 			}
-			switch varName {
-			case "":
-				return fmt.Errorf("invalid variable name %q", varName)
-			case "WORK":
-				return fmt.Errorf("cannot override WORK variable")
+			for _, v := range envVars.vals {
+				varName, _, ok := strings.Cut(v, "=")
+				if !ok {
+					v += "=" + os.Getenv(v)
+				}
+				switch varName {
+				case "":
+					return fmt.Errorf("invalid variable name %q", varName)
+				case "WORK":
+					return fmt.Errorf("cannot override WORK variable")
+				}
+				env.Vars = append(env.Vars, v)
 			}
-			env.Vars = append(env.Vars, v)
+			return nil
 		}
-		return nil
+		configGroups[cfg.file] = len(groups)
+		groupOf[file] = len(groups)
+		groups = append(groups, p)
 	}
 
-	r := &runT{
-		verbose:       *fVerbose,
-		stdinTempFile: stdinTempFile,
+	var jsonOut io.Writer
+	if *fJSON {
+		jsonOut = os.Stdout
 	}
-	r.Run("", func(t testscript.T) {
-		testscript.RunT(t, p)
-	})
-	if r.failed.Load() {
+	run := func(files []string) (*report, error) {
+		groupFiles := make([][]string, len(groups))
+		for _, file := range files {
+			i := groupOf[file]
+			groupFiles[i] = append(groupFiles[i], file)
+		}
+		r := &runT{
+			verbose:       *fVerbose,
+			stdinTempFile: stdinTempFile,
+			report:        newReport(jsonOut),
+			failed:        new(atomic.Bool),
+		}
+		for range *fCount {
+			for i, p := range groups {
+				if len(groupFiles[i]) == 0 {
+					continue
+				}
+				p.Files = groupFiles[i]
+				r.Run("", func(t testscript.T) {
+					testscript.RunT(t, p)
+				})
+			}
+		}
+		r.report.finish(r.failed.Load())
+		if *fJUnit != "" {
+			if err := r.report.writeJUnit(*fJUnit); err != nil {
+				return nil, err
+			}
+		}
+		return r.report, nil
+	}
+	if *fWatch {
+		w, err := newWatcher(files, watchPaths)
+		if err != nil {
+			return err
+		}
+		return watch(os.Stdout, files, w.next, run)
+	}
+	r, err := run(files)
+	if err != nil {
+		return err
+	}
+	if !*fJSON && len(r.results) > 1 {
+		writeSummary(os.Stderr, r)
+	}
+	if r.failed {
 		return failedRun
 	}
 	return nil
@@ -159,10 +311,17 @@ var (
 type runT struct {
 	verbose       bool
 	stdinTempFile string
-	failed        atomic.Bool
+	report        *report
+	failed        *atomic.Bool
+
+	// name, output and skipMsg are set for each script run.
+	name    string
+	output  strings.Builder
+	skipMsg string
 }
 
 func (r *runT) Skip(is ...any) {
+	r.skipMsg = fmt.Sprint(is...)
 	panic(skipRun)
 }
 
@@ -183,6 +342,11 @@ func (r *runT) Log(is ...any) {
 	if !strings.HasSuffix(msg, "\n") {
 		msg += "\n"
 	}
+	r.output.WriteString(msg)
+	if r.report.isJSON() {
+		r.report.output(r.name, msg)
+		return
+	}
 	fmt.Print(msg)
 }
 
@@ -193,16 +357,41 @@ func (r *runT) FailNow() {
 func (r *runT) Run(name string, f func(t testscript.T)) {
 	// TODO: perhaps log the test name when there's more
 	// than one test file?
+	t := r
+	if name != "" {
+		t = &runT{
+			verbose:       r.verbose,
+			stdinTempFile: r.stdinTempFile,
+			report:        r.report,
+			failed:        r.failed,
+			name:          name,
+		}
+		r.report.run(name)
+	}
+	start := time.Now()
 	defer func() {
+		status := "pass"
 		switch err := recover(); err {
-		case nil, skipRun:
+		case nil:
+		case skipRun:
+			status = "skip"
 		case failedRun:
+			status = "fail"
 			r.failed.Store(true)
 		default:
 			panic(fmt.Errorf("unexpected panic: %v [%T]", err, err))
 		}
+		if name != "" {
+			r.report.done(scriptResult{
+				name:    name,
+				status:  status,
+				elapsed: time.Since(start),
+				output:  t.output.String(),
+				skipMsg: t.skipMsg,
+			})
+		}
 	}()
-	f(r)
+	f(t)
 }
 
 func (r *runT) Verbose() bool {
@@ -6,11 +6,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rogpeppe/go-internal/gotooltest"
 	"github.com/rogpeppe/go-internal/internal/os/execpath"
@@ -114,3 +121,282 @@ func expandone(ts *testscript.TestScript, neg bool, args []string) {
 		ts.Fatalf("expandone: %q matched %v files, not 1", glob, n)
 	}
 }
+
+func TestWatcherChanged(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	bin := filepath.Join(dir, "bin")
+	for _, f := range []string{a, b, bin} {
+		if err := os.WriteFile(f, []byte("x"), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := newWatcher([]string{a, b}, []string{bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.changed(); len(got) != 0 {
+		t.Fatalf("unexpected changes before any edit: %q", got)
+	}
+
+	// Changing a script reruns just that script.
+	if err := os.WriteFile(b, []byte("xy"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.changed(), []string{b}; !slices.Equal(got, want) {
+		t.Fatalf("after editing b: got %q, want %q", got, want)
+	}
+	if got := w.changed(); len(got) != 0 {
+		t.Fatalf("changes reported twice: %q", got)
+	}
+
+	// Changing an extra path reruns all of them.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(bin, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.changed(), []string{a, b}; !slices.Equal(got, want) {
+		t.Fatalf("after touching bin: got %q, want %q", got, want)
+	}
+
+	// So does removing a script.
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.changed(), []string{a}; !slices.Equal(got, want) {
+		t.Fatalf("after removing a: got %q, want %q", got, want)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// The first run covers all the scripts, and each later run
+	// covers only those reported as changed.
+	changes := [][]string{{"b.txt"}, {"a.txt"}}
+	next := func() []string {
+		c := changes[0]
+		changes = changes[1:]
+		return c
+	}
+	var runs [][]string
+	errStop := errors.New("stop")
+	run := func(files []string) (*report, error) {
+		runs = append(runs, files)
+		if len(runs) > 2 {
+			return nil, errStop
+		}
+		r := &report{}
+		for _, f := range files {
+			r.results = append(r.results, scriptResult{
+				name:   strings.TrimSuffix(f, ".txt"),
+				status: "pass",
+			})
+		}
+		return r, nil
+	}
+	var out bytes.Buffer
+	if err := watch(&out, []string{"a.txt", "b.txt"}, next, run); err != errStop {
+		t.Fatalf("watch returned %v; want %v", err, errStop)
+	}
+	want := [][]string{{"a.txt", "b.txt"}, {"b.txt"}, {"a.txt"}}
+	if !slices.EqualFunc(runs, want, slices.Equal) {
+		t.Fatalf("got runs %q; want %q", runs, want)
+	}
+	summaries := strings.Split(out.String(), "\033[H\033[2J")[1:]
+	wantSummaries := []string{
+		"\nPASS  a  0.000s\nPASS  b  0.000s\nPASS: 2 scripts, 0 failed, 0 skipped\nwatching for changes; press Ctrl-C to stop\n",
+		"\nPASS  b  0.000s\nPASS: 1 scripts, 0 failed, 0 skipped\nwatching for changes; press Ctrl-C to stop\n",
+		"",
+	}
+	if !slices.Equal(summaries, wantSummaries) {
+		t.Fatalf("unexpected output:\n%q\nwant:\n%q", summaries, wantSummaries)
+	}
+}
+
+func TestLSP(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "script.txtar")
+	script := `exec echo hello
+stdout hello
+cmp greeting.txt want.txt
+bogus arg
+[linux] exec true
+-- greeting.txt --
+hi
+-- want.txt --
+bye
+`
+	if err := os.WriteFile(file, []byte(script), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.ToSlash(file)
+	if runtime.GOOS == "windows" {
+		uri = "file:///" + filepath.ToSlash(file)
+	}
+	position := func(line, char int) map[string]any {
+		return map[string]any{
+			"textDocument": map[string]any{"uri": uri},
+			"position":     map[string]any{"line": line, "character": char},
+		}
+	}
+
+	var in bytes.Buffer
+	id := 0
+	send := func(method string, params any) {
+		msg := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+		if !strings.HasPrefix(method, "textDocument/did") && method != "exit" {
+			id++
+			msg["id"] = id
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	}
+	send("initialize", map[string]any{}) // 1
+	send("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{"uri": uri, "languageId": "txtar", "version": 1, "text": script},
+	})
+	send("textDocument/completion", position(0, 2))  // 2
+	send("textDocument/completion", position(4, 3))  // 3
+	send("textDocument/hover", position(0, 1))       // 4
+	send("textDocument/hover", position(4, 2))       // 5
+	send("textDocument/definition", position(2, 6))  // 6
+	send("textDocument/codeAction", position(0, 0))  // 7
+	send("workspace/executeCommand", map[string]any{ // 8
+		"command":   runCommand,
+		"arguments": []string{uri},
+	})
+	send("shutdown", nil)
+	send("exit", nil)
+
+	var out bytes.Buffer
+	s := newLSPServer(&in, &out)
+	release := make(chan struct{})
+	s.runScript = func(path string) ([]byte, error) {
+		// The script does not run until the server has
+		// answered every request, which shows that running
+		// it does not block the server.
+		<-release
+		cmd := exec.Command("testscript", path)
+		return cmd.CombinedOutput()
+	}
+	if err := s.serve(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	s.runs.Wait()
+
+	type message struct {
+		ID     int
+		Method string
+		Params struct {
+			Diagnostics []lspDiagnostic
+			Message     string
+		}
+		Result json.RawMessage
+	}
+	results := make(map[int]json.RawMessage)
+	var diags [][]lspDiagnostic
+	var shown []string
+	for _, part := range strings.Split(out.String(), "Content-Length: ")[1:] {
+		_, body, _ := strings.Cut(part, "\r\n\r\n")
+		var msg message
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Method {
+		case "textDocument/publishDiagnostics":
+			diags = append(diags, msg.Params.Diagnostics)
+		case "window/showMessage":
+			shown = append(shown, msg.Params.Message)
+		case "":
+			results[msg.ID] = msg.Result
+		}
+	}
+	labels := func(id int) []string {
+		var items []lspCompletionItem
+		if err := json.Unmarshal(results[id], &items); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, item := range items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+
+	// Opening the document reports the unknown command.
+	if len(diags) != 2 || len(diags[0]) != 1 {
+		t.Fatalf("unexpected diagnostics %+v", diags)
+	}
+	if d := diags[0][0]; d.Range.Start.Line != 3 || d.Message != `unknown command "bogus"` {
+		t.Errorf("unexpected diagnostic %+v", d)
+	}
+	if got := labels(2); !slices.Contains(got, "exec") || !slices.Contains(got, "if") || slices.Contains(got, "linux") {
+		t.Errorf("unexpected command completions %q", got)
+	}
+	if got := labels(3); !slices.Contains(got, "exec:") || slices.Contains(got, "exec") {
+		t.Errorf("unexpected condition completions %q", got)
+	}
+	if got := string(results[4]); !strings.Contains(got, "Run the given executable program") {
+		t.Errorf("unexpected command hover %s", got)
+	}
+	if got := string(results[5]); !strings.Contains(got, "GOOS matches") {
+		t.Errorf("unexpected condition hover %s", got)
+	}
+	if got, want := string(results[6]), `"start":{"line":5,"character":0}`; !strings.Contains(got, want) {
+		t.Errorf("unexpected definition %s, want %s", got, want)
+	}
+	if got := string(results[7]); !strings.Contains(got, runCommand) {
+		t.Errorf("unexpected code actions %s", got)
+	}
+
+	// Running the script reports the line on which it failed.
+	if len(diags[1]) != 2 {
+		t.Fatalf("unexpected diagnostics after run %+v", diags[1])
+	}
+	if d := diags[1][1]; d.Range.Start.Line != 2 || !strings.HasPrefix(d.Message, "greeting.txt and want.txt differ") {
+		t.Errorf("unexpected run diagnostic %+v", d)
+	}
+	if len(shown) != 1 || !strings.HasPrefix(shown[0], "FAIL: script.txtar:3:") {
+		t.Errorf("unexpected messages %q", shown)
+	}
+}
+
+func TestLSPConfigChange(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, configName)
+	uri := "file://" + filepath.ToSlash(filepath.Join(dir, "script.txtar"))
+	if runtime.GOOS == "windows" {
+		uri = "file:///" + filepath.ToSlash(filepath.Join(dir, "script.txtar"))
+	}
+	s := newLSPServer(strings.NewReader(""), io.Discard)
+	hasCommand := func(name string) bool {
+		p, err := s.paramsFor(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := p.Commands[name]
+		return ok
+	}
+
+	if err := os.WriteFile(conf, []byte("command foo echo\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCommand("foo") {
+		t.Fatal("command foo not configured")
+	}
+	// Changing the configuration file changes the parameters.
+	if err := os.WriteFile(conf, []byte("command bar echo\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(conf, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCommand("bar") || hasCommand("foo") {
+		t.Fatal("configuration change not seen")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// reportPackage is used as the package name in JSON events
+// and as the suite name in JUnit reports.
+const reportPackage = "testscript"
+
+// report records the results of running each script, writing JSON
+// events as it goes when json is non-nil.
+type report struct {
+	json  *json.Encoder
+	start time.Time
+
+	mu      sync.Mutex
+	results []scriptResult
+
+	// failed is set by finish.
+	failed bool
+}
+
+// scriptResult holds the outcome of running a single script.
+type scriptResult struct {
+	name    string
+	status  string // "pass", "fail" or "skip"
+	elapsed time.Duration
+	output  string
+	skipMsg string
+}
+
+// testEvent is a JSON event in the format produced by test2json.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+func newReport(jsonOut io.Writer) *report {
+	r := &report{
+		start: time.Now(),
+	}
+	if jsonOut != nil {
+		r.json = json.NewEncoder(jsonOut)
+		r.event(testEvent{Action: "start"})
+	}
+	return r
+}
+
+// event writes e as JSON, if JSON output was requested.
+func (r *report) event(e testEvent) {
+	if r.json == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Package = reportPackage
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.json.Encode(e)
+}
+
+// isJSON reports whether log output should be written as JSON
+// events rather than printed directly.
+func (r *report) isJSON() bool {
+	return r.json != nil
+}
+
+// run records that the named script has started.
+func (r *report) run(name string) {
+	r.event(testEvent{Action: "run", Test: name})
+	r.event(testEvent{Action: "output", Test: name, Output: "=== RUN   " + name + "\n"})
+}
+
+// output records output logged by the named script. As with
+// test2json, each line is reported as a separate event.
+func (r *report) output(name, msg string) {
+	for line := range strings.Lines(msg) {
+		r.event(testEvent{Action: "output", Test: name, Output: line})
+	}
+}
+
+// done records the outcome of the named script.
+func (r *report) done(res scriptResult) {
+	r.mu.Lock()
+	r.results = append(r.results, res)
+	r.mu.Unlock()
+	r.event(testEvent{
+		Action: "output",
+		Test:   res.name,
+		Output: fmt.Sprintf("--- %s: %s (%.2fs)\n", statusWords[res.status], res.name, res.elapsed.Seconds()),
+	})
+	r.event(testEvent{Action: res.status, Test: res.name, Elapsed: elapsed(res.elapsed)})
+}
+
+var statusWords = map[string]string{
+	"pass": "PASS",
+	"fail": "FAIL",
+	"skip": "SKIP",
+}
+
+// finish records the outcome of the whole run.
+func (r *report) finish(failed bool) {
+	r.failed = failed
+	status := "pass"
+	if failed {
+		status = "fail"
+	}
+	r.event(testEvent{Action: "output", Output: statusWords[status] + "\n"})
+	r.event(testEvent{Action: status, Elapsed: elapsed(time.Since(r.start))})
+}
+
+// elapsed returns d in seconds, rounded to the
+// precision used by test2json.
+func elapsed(d time.Duration) float64 {
+	return float64(d.Round(time.Millisecond)) / float64(time.Second)
+}
+
+// writeSummary writes a table of the scripts that were run, slowest
+// first, followed by the overall result.
+func writeSummary(w io.Writer, r *report) {
+	results := slices.Clone(r.results)
+	slices.SortStableFunc(results, func(a, b scriptResult) int {
+		return cmp.Compare(b.elapsed, a.elapsed)
+	})
+	var failed, skipped int
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, res := range results {
+		switch res.status {
+		case "fail":
+			failed++
+		case "skip":
+			skipped++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.3fs\n", statusWords[res.status], res.name, res.elapsed.Seconds())
+	}
+	tw.Flush()
+	status := "PASS"
+	if r.failed {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s: %d scripts, %d failed, %d skipped\n", status, len(results), failed, skipped)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut *junitOutput  `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",cdata"`
+}
+
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+// writeJUnit writes the results as a JUnit XML report to the named file.
+func (r *report) writeJUnit(file string) error {
+	suite := junitTestSuite{
+		Name: reportPackage,
+		Time: junitTime(time.Since(r.start)),
+	}
+	for _, res := range r.results {
+		tc := junitTestCase{
+			Name:      res.name,
+			Classname: reportPackage,
+			Time:      junitTime(res.elapsed),
+		}
+		switch res.status {
+		case "fail":
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: "Failed", Text: res.output}
+		case "skip":
+			suite.Skipped++
+			msg := res.skipMsg
+			if msg == "" {
+				msg = "Skipped"
+			}
+			tc.Skipped = &junitMessage{Message: msg, Text: res.output}
+		default:
+			tc.SystemOut = &junitOutput{res.output}
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	data = append(data, '\n')
+	if err := os.WriteFile(file, data, 0o666); err != nil {
+		return fmt.Errorf("cannot write JUnit report: %v", err)
+	}
+	return nil
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// expandScripts returns the script files named by args. A directory
+// argument stands for the .txt and .txtar files it contains, as with
+// testscript.Params.Dir, and a directory argument ending in "/..."
+// also includes the files in its subdirectories. Files whose script
+// names do not match run, if it is non-nil, are omitted. The special
+// name "-" is returned as is.
+func expandScripts(args []string, run *regexp.Regexp) ([]string, error) {
+	var files []string
+	add := func(file string) {
+		if run == nil || run.MatchString(scriptName(file)) {
+			files = append(files, file)
+		}
+	}
+	for _, arg := range args {
+		if arg == "-" {
+			files = append(files, arg)
+			continue
+		}
+		if dir, ok := strings.CutSuffix(filepath.ToSlash(arg), "/..."); ok {
+			err := filepath.WalkDir(filepath.FromSlash(dir), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					// Skip hidden directories such as .git, but not
+					// the root, which may well be ".".
+					if path != filepath.FromSlash(dir) && strings.HasPrefix(d.Name(), ".") {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if isScript(d.Name()) {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			// Let testscript report any error.
+			add(arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && isScript(entry.Name()) {
+				add(filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// isScript reports whether the named file is a script,
+// using the same rule as testscript.Params.Dir.
+func isScript(name string) bool {
+	return strings.HasSuffix(name, ".txtar") || strings.HasSuffix(name, ".txt")
+}
+
+// scriptName returns the name that testscript gives the script
+// in the named file.
+func scriptName(file string) string {
+	name := filepath.Base(file)
+	if name1, ok := strings.CutSuffix(name, ".txt"); ok {
+		return name1
+	}
+	return strings.TrimSuffix(name, ".txtar")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often the watched files are polled for changes.
+const watchInterval = 500 * time.Millisecond
+
+// watch runs the scripts and then reruns them as they change, until
+// the process is interrupted, writing a summary of each run to out.
+// The scripts to rerun are given by next, which blocks until some
+// have changed. It returns only if a run could not be completed.
+func watch(out io.Writer, files []string, next func() []string, run func(files []string) (*report, error)) error {
+	toRun := files
+	for {
+		// Clear the screen so that only the latest run is visible.
+		fmt.Fprint(out, "\033[H\033[2J")
+		r, err := run(toRun)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out)
+		writeSummary(out, r)
+		fmt.Fprintln(out, "watching for changes; press Ctrl-C to stop")
+		toRun = next()
+	}
+}
+
+// watchPath returns the file to watch for the given -watchpath
+// argument. An argument that does not name an existing file and
+// contains no path separator is looked up in $PATH, so that
+// commands used by the scripts can be watched by name.
+func watchPath(path string) (string, error) {
+	if _, err := os.Stat(path); err == nil || strings.ContainsAny(path, `/\`) {
+		return path, nil
+	}
+	p, err := exec.LookPath(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot watch %q: %v", path, err)
+	}
+	return p, nil
+}
+
+// watcher keeps track of the state of the watched files.
+type watcher struct {
+	scripts []string
+	extra   []string
+	states  map[string]fileState
+}
+
+// fileState holds what is checked to determine whether a file
+// has changed. The zero value represents a missing file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// newWatcher returns a watcher for the given scripts, which are rerun
+// when their own file changes, and all of which are rerun when any of
+// the extra paths change, as given by the -watchpath flag.
+func newWatcher(scripts, extra []string) (*watcher, error) {
+	w := &watcher{
+		scripts: scripts,
+		extra:   make([]string, len(extra)),
+		states:  make(map[string]fileState),
+	}
+	for i, path := range extra {
+		p, err := watchPath(path)
+		if err != nil {
+			return nil, err
+		}
+		w.extra[i] = p
+		w.update(p)
+	}
+	for _, path := range scripts {
+		w.update(path)
+	}
+	return w, nil
+}
+
+// next polls the watched files until some scripts need to be run
+// again, and returns them.
+func (w *watcher) next() []string {
+	for {
+		time.Sleep(watchInterval)
+		if scripts := w.changed(); len(scripts) > 0 {
+			return scripts
+		}
+	}
+}
+
+// changed returns the scripts that need to be run again because
+// they or any of the extra paths have changed since the last call.
+func (w *watcher) changed() []string {
+	all := false
+	for _, path := range w.extra {
+		if w.update(path) {
+			all = true
+		}
+	}
+	var scripts []string
+	for _, path := range w.scripts {
+		if w.update(path) || all {
+			scripts = append(scripts, path)
+		}
+	}
+	return scripts
+}
+
+// update records the current state of the file at path,
+// reporting whether it has changed.
+func (w *watcher) update(path string) bool {
+	var state fileState
+	if info, err := os.Stat(path); err == nil {
+		state = fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+	}
+	old, ok := w.states[path]
+	w.states[path] = state
+	return ok && old != state
+}
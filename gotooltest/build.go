@@ -0,0 +1,119 @@
+package gotooltest
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// BuildOptions holds options for BuildCommands.
+type BuildOptions struct {
+	// Cover builds the commands with coverage instrumentation, as by
+	// "go build -cover". The commands write their coverage data to
+	// the directory named by $GOCOVERDIR in each script, which is
+	// set as described for testscript.Params.CoverDir, so that the
+	// data is included in any coverage report. When no such
+	// directory is set, each script is given a temporary one so
+	// that the commands do not warn about its absence, and the data
+	// is discarded.
+	Cover bool
+
+	// Race builds the commands with the race detector enabled.
+	Race bool
+
+	// Flags holds any further flags to pass to go build,
+	// for example "-tags=integration".
+	Flags []string
+}
+
+// BuildCommands builds the main packages named by pkgs with the go
+// command found in PATH, and adds the resulting binaries to
+// p.Executables, so that scripts can run them by name and find them
+// in $PATH. Each command is named after the last element of its
+// package path, as by "go build", and must not already be in
+// p.Executables.
+//
+// The packages are built once, when BuildCommands is called, and the
+// binaries are used by all the scripts run with p. They are removed
+// when t finishes. Binaries are not shared between calls, even for the
+// same packages and options: the go command caches the compiled
+// packages, so building them again costs little more than linking,
+// and there is no later point at which shared binaries could be
+// removed. Package paths are interpreted as by "go build" in
+// the current directory, so relative paths such as "./cmd/foo" name
+// packages in the module being tested.
+func BuildCommands(t testing.TB, p *testscript.Params, opts BuildOptions, pkgs ...string) {
+	t.Helper()
+	if len(pkgs) == 0 {
+		t.Fatal("gotooltest.BuildCommands: no packages to build")
+	}
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	if err := os.Mkdir(binDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"build", "-o", binDir + string(filepath.Separator)}
+	if opts.Cover {
+		args = append(args, "-cover")
+	}
+	if opts.Race {
+		args = append(args, "-race")
+	}
+	args = append(args, opts.Flags...)
+	args = append(args, pkgs...)
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("cannot build commands: go %s: %v\n%s", strings.Join(args, " "), err, &stderr)
+	}
+
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("cannot build commands: no main packages in %s", strings.Join(pkgs, " "))
+	}
+	if p.Executables == nil {
+		p.Executables = make(map[string]string)
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), exeSuffix())
+		if _, ok := p.Executables[name]; ok {
+			t.Fatalf("cannot build command %s: it is already in Executables", name)
+		}
+		p.Executables[name] = filepath.Join(binDir, entry.Name())
+	}
+
+	if opts.Cover {
+		coverRoot := filepath.Join(dir, "cover")
+		origSetup := p.Setup
+		p.Setup = func(e *testscript.Env) error {
+			if origSetup != nil {
+				if err := origSetup(e); err != nil {
+					return err
+				}
+			}
+			// Check only after the caller's Setup,
+			// which may set GOCOVERDIR itself.
+			if e.Getenv("GOCOVERDIR") != "" {
+				return nil
+			}
+			if err := os.MkdirAll(coverRoot, 0o777); err != nil {
+				return err
+			}
+			coverDir, err := os.MkdirTemp(coverRoot, "script")
+			if err != nil {
+				return err
+			}
+			e.Setenv("GOCOVERDIR", coverDir)
+			return nil
+		}
+	}
+}
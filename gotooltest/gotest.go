@@ -0,0 +1,198 @@
+package gotooltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/internal/os/execpath"
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// gotestKey is the key in testscript.Env.Values of the
+// *gotestResults recording the last gotest run of a script.
+type gotestKey struct{}
+
+// gotestResults holds the outcomes recorded by the last gotest command.
+type gotestResults struct {
+	ran  bool
+	pkgs map[string]*testResult
+}
+
+// testResult holds the outcome of a package or of a single test.
+type testResult struct {
+	status string // "pass", "fail", "skip", or empty if unfinished
+	output strings.Builder
+	tests  map[string]*testResult // for packages only
+}
+
+// testEvent is an event written by go test -json; see go doc test2json.
+type testEvent struct {
+	Action     string
+	Package    string
+	ImportPath string // for build events
+	Test       string
+	Output     string
+}
+
+var gotestCmds = map[string]testscript.Cmd{
+	"gotest": {
+		Run:       cmdGotest,
+		Args:      "[args...]",
+		Summary:   "Run go test -json with the given arguments, recording the outcome of each package and test.",
+		Negatable: true,
+		Detail: `The go command runs as for the go command. The text of the test output,
+rather than the JSON events, becomes the standard output. The recorded
+outcomes are checked by the testresult and testoutput commands.`,
+	},
+	"testresult": {
+		Run:       cmdTestresult,
+		Args:      "pkg [test] pass|fail|skip",
+		Summary:   "Check the outcome of the given package, or of the test in that package, in the last gotest run.",
+		Negatable: true,
+		Detail: `Packages are named by import path and tests by the names reported by
+go test, such as TestFoo/subtest.`,
+	},
+	"testoutput": {
+		Run:       cmdTestoutput,
+		Args:      "pkg [test] pattern",
+		Summary:   "Check that the output of the given package, or of the test in that package, in the last gotest run matches the regular expression pattern.",
+		Negatable: true,
+	},
+}
+
+func cmdGotest(ts *testscript.TestScript, neg bool, args []string) {
+	results := ts.Value(gotestKey{}).(*gotestResults)
+	// Run go test directly rather than with ts.Exec, which would log
+	// the raw JSON as well as the test output written below.
+	goBin, err := execpath.Look("go", ts.Getenv)
+	ts.Check(err)
+	cmd := exec.Command(goBin, append([]string{"test", "-json"}, args...)...)
+	cmd.Dir = ts.MkAbs(".")
+	cmd.Env = ts.Environ()
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = ts.Stderr()
+	runErr := cmd.Run()
+	if runErr != nil && !errors.As(runErr, new(*exec.ExitError)) {
+		ts.Fatalf("%v", runErr)
+	}
+
+	*results = gotestResults{
+		ran:  true,
+		pkgs: make(map[string]*testResult),
+	}
+	dec := json.NewDecoder(&stdout)
+	for {
+		var ev testEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			ts.Fatalf("cannot parse go test -json output: %v", err)
+		}
+		io.WriteString(ts.Stdout(), ev.Output)
+		pkgPath := ev.Package
+		if pkgPath == "" {
+			// A build event, which may name a test variant of
+			// the package such as "p [p.test]".
+			pkgPath, _, _ = strings.Cut(ev.ImportPath, " ")
+		}
+		if pkgPath == "" {
+			continue
+		}
+		pkg := results.pkgs[pkgPath]
+		if pkg == nil {
+			pkg = &testResult{tests: make(map[string]*testResult)}
+			results.pkgs[pkgPath] = pkg
+		}
+		res := pkg
+		if ev.Test != "" {
+			res = pkg.tests[ev.Test]
+			if res == nil {
+				res = &testResult{}
+				pkg.tests[ev.Test] = res
+			}
+		}
+		res.output.WriteString(ev.Output)
+		switch ev.Action {
+		case "pass", "fail", "skip":
+			res.status = ev.Action
+		}
+	}
+
+	if neg {
+		if runErr == nil {
+			ts.Fatalf("unexpected gotest success")
+		}
+		return
+	}
+	if runErr != nil {
+		ts.Fatalf("unexpected gotest failure: %v", runErr)
+	}
+}
+
+// lookupResult returns the recorded outcome for the package
+// named by args[0] or, if present, the test named by args[1],
+// along with a description of it for use in messages.
+func lookupResult(ts *testscript.TestScript, args []string) (*testResult, string) {
+	results := ts.Value(gotestKey{}).(*gotestResults)
+	if !results.ran {
+		ts.Fatalf("no gotest command has been run")
+	}
+	pkg := results.pkgs[args[0]]
+	if pkg == nil {
+		ts.Fatalf("no result for package %s", args[0])
+	}
+	if len(args) == 1 {
+		return pkg, "package " + args[0]
+	}
+	res := pkg.tests[args[1]]
+	if res == nil {
+		ts.Fatalf("no result for test %s in package %s", args[1], args[0])
+	}
+	return res, fmt.Sprintf("test %s in package %s", args[1], args[0])
+}
+
+func cmdTestresult(ts *testscript.TestScript, neg bool, args []string) {
+	want := args[len(args)-1]
+	switch want {
+	case "pass", "fail", "skip":
+	default:
+		ts.Fatalf("invalid status %q; want pass, fail or skip", want)
+	}
+	res, what := lookupResult(ts, args[:len(args)-1])
+	status := res.status
+	if status == "" {
+		status = "unfinished"
+	}
+	if neg {
+		if status == want {
+			ts.Fatalf("unexpected status %s for %s", status, what)
+		}
+		return
+	}
+	if status != want {
+		ts.Fatalf("%s has status %s, want %s", what, status, want)
+	}
+}
+
+func cmdTestoutput(ts *testscript.TestScript, neg bool, args []string) {
+	pattern := args[len(args)-1]
+	re, err := regexp.Compile(`(?m)` + pattern)
+	ts.Check(err)
+	res, what := lookupResult(ts, args[:len(args)-1])
+	if neg {
+		if re.MatchString(res.output.String()) {
+			ts.Fatalf("unexpected match for %#q in output of %s", pattern, what)
+		}
+		return
+	}
+	if !re.MatchString(res.output.String()) {
+		ts.Fatalf("no match for %#q in output of %s", pattern, what)
+	}
+}
@@ -5,8 +5,14 @@
 package gotooltest_test
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/rogpeppe/go-internal/gotooltest"
@@ -34,3 +40,160 @@ func TestSimple(t *testing.T) {
 	}
 	testscript.Run(t, p)
 }
+
+func TestToolchains(t *testing.T) {
+	out, err := exec.Command("go", "env", "GOROOT", "GOVERSION").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goroot, goversion, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	// The scripts expect each toolchain's GOROOT, its version, and
+	// whether it satisfies [go1.4], which tells the release tags apart.
+	type want struct {
+		version string
+		tags    string
+	}
+	wants := map[string]want{
+		goroot: {goversion, "new"},
+	}
+	goroots := []string{goroot}
+	if runtime.GOOS != "windows" {
+		fake := fakeToolchain(t)
+		wants[fake] = want{"go1.3.9", "old"}
+		goroots = append(goroots, fake)
+	}
+	var (
+		mu   sync.Mutex
+		used = make(map[string]bool)
+	)
+	p := testscript.Params{
+		Dir: filepath.Join("testdata", "toolchain"),
+		Setup: func(env *testscript.Env) error {
+			goroot := env.Getenv("GOROOT")
+			want, ok := wants[goroot]
+			if !ok {
+				return fmt.Errorf("unexpected GOROOT %q", goroot)
+			}
+			mu.Lock()
+			used[goroot] = true
+			mu.Unlock()
+			env.Setenv("WANTGOROOT", goroot)
+			env.Setenv("WANTVERSION", want.version)
+			env.Setenv("WANTTAGS", want.tags)
+			return nil
+		},
+	}
+	gotooltest.RunToolchains(t, p, goroots...)
+	for _, goroot := range goroots {
+		if !used[goroot] {
+			t.Errorf("toolchain in %s was not used", goroot)
+		}
+	}
+}
+
+// fakeToolchain returns the GOROOT of a fake Go 1.3.9 toolchain,
+// whose go command only answers the questions asked of it by
+// RunToolchains and the toolchain scripts.
+func fakeToolchain(t *testing.T) string {
+	goroot := t.TempDir()
+	bin := filepath.Join(goroot, "bin")
+	if err := os.Mkdir(bin, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`#!/bin/sh
+case "$*" in
+"list -f={{context.ReleaseTags}} runtime")
+	echo '[go1.1 go1.2 go1.3]';;
+"env -json GOCACHE GOPROXY GOROOT GOVERSION")
+	echo '{"GOCACHE": %[1]q, "GOPROXY": "off", "GOROOT": %[2]q, "GOVERSION": "go1.3.9"}';;
+"env GOROOT GOTOOLCHAIN")
+	echo %[2]q
+	echo "$GOTOOLCHAIN";;
+version)
+	echo 'go version go1.3.9 fake/arch';;
+*)
+	echo "unexpected go $*" >&2
+	exit 1;;
+esac
+`, filepath.Join(goroot, "cache"), goroot)
+	if err := os.WriteFile(filepath.Join(bin, "go"), []byte(script), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	return goroot
+}
+
+func TestSDKToolchains(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	goExe := "go"
+	if runtime.GOOS == "windows" {
+		goExe += ".exe"
+	}
+	for _, dir := range []string{"go1.9", "go1.21.0", "go1.22rc1", "go1.20"} {
+		bin := filepath.Join(home, "sdk", dir, "bin")
+		if err := os.MkdirAll(bin, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if dir == "go1.20" {
+			// Not fully installed.
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(bin, goExe), nil, 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := gotooltest.SDKToolchains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, dir := range []string{"go1.22rc1", "go1.21.0", "go1.9"} {
+		want = append(want, filepath.Join(home, "sdk", dir))
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildCommands(t *testing.T) {
+	for _, cover := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cover=%v", cover), func(t *testing.T) {
+			p := testscript.Params{
+				Dir: filepath.Join("testdata", "build"),
+			}
+			gotooltest.BuildCommands(t, &p, gotooltest.BuildOptions{Cover: cover}, "../cmd/txtar-c", "../cmd/txtar-x")
+			if len(p.Executables) != 2 {
+				t.Fatalf("unexpected executables %v", p.Executables)
+			}
+			testscript.Run(t, p)
+		})
+	}
+}
+
+func TestBuildCommandsCoverDir(t *testing.T) {
+	// A GOCOVERDIR set by the caller's Setup is used by the
+	// commands built with coverage, and BuildCommands only
+	// provides one after the caller's Setup has run.
+	coverDir := t.TempDir()
+	p := testscript.Params{
+		Dir: filepath.Join("testdata", "build"),
+		Setup: func(env *testscript.Env) error {
+			if env.Getenv("GOCOVERDIR") == "" {
+				env.Setenv("GOCOVERDIR", coverDir)
+			}
+			return nil
+		},
+	}
+	gotooltest.BuildCommands(t, &p, gotooltest.BuildOptions{Cover: true}, "../cmd/txtar-c", "../cmd/txtar-x")
+	t.Run("run", func(t *testing.T) {
+		testscript.Run(t, p)
+	})
+	entries, err := os.ReadDir(coverDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("no coverage data written to GOCOVERDIR")
+	}
+}
@@ -8,6 +8,7 @@ package gotooltest
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -25,22 +26,39 @@ var (
 	goVersionRegex = regexp.MustCompile(`^go([1-9][0-9]*)\.([1-9][0-9]*)$`)
 
 	goEnv struct {
-		GOROOT      string
-		GOCACHE     string
-		GOPROXY     string
-		goversion   string
-		releaseTags []string
-		once        sync.Once
-		err         error
+		toolchain
+		once sync.Once
+		err  error
 	}
 )
 
+// toolchain holds what scripts need to know about
+// the Go toolchain used by their go command.
+type toolchain struct {
+	GOROOT      string
+	GOCACHE     string
+	GOPROXY     string
+	GOVERSION   string // only set for toolchains in an explicit GOROOT
+	goversion   string
+	releaseTags []string
+
+	// bin holds the directory added to the front of PATH
+	// so that scripts use the toolchain's go command. It is
+	// empty for the go command found in PATH.
+	bin string
+}
+
 // initGoEnv initialises goEnv. It should only be called using goEnv.once.Do,
 // as in Setup.
+func initGoEnv() error {
+	return probeToolchain(&goEnv.toolchain, "go")
+}
+
+// probeToolchain initialises tc by running the given go command.
 //
 // Run all of these probe commands in a temporary directory, so as not to make
 // any assumptions about the caller's working directory.
-func initGoEnv() (err error) {
+func probeToolchain(tc *toolchain, goCmd string) (err error) {
 	td, err := os.MkdirTemp("", "gotooltest-initGoEnv")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary directory for go command tests: %w", err)
@@ -59,36 +77,51 @@ func initGoEnv() (err error) {
 
 	run := func(args ...string) (*bytes.Buffer, *bytes.Buffer, error) {
 		var stdout, stderr bytes.Buffer
-		cmd := exec.Command(args[0], args[1:]...)
+		cmd := exec.Command(goCmd, args...)
 		cmd.Dir = td
+		if tc.bin != "" {
+			cmd.Env = toolchainEnviron(os.Environ())
+		}
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
 		return &stdout, &stderr, cmd.Run()
 	}
 
-	lout, stderr, err := run("go", "list", "-f={{context.ReleaseTags}}", "runtime")
+	lout, stderr, err := run("list", "-f={{context.ReleaseTags}}", "runtime")
 	if err != nil {
 		return fmt.Errorf("failed to determine release tags from go command: %v\n%v", err, stderr.String())
 	}
 	tagStr := strings.TrimSpace(lout.String())
 	tagStr = strings.Trim(tagStr, "[]")
-	goEnv.releaseTags = strings.Split(tagStr, " ")
+	tc.releaseTags = strings.Split(tagStr, " ")
 
-	if err := goenv.Unmarshal(&goEnv); err != nil {
-		return err
+	if tc.bin == "" {
+		if err := goenv.Unmarshal(tc); err != nil {
+			return err
+		}
+	} else {
+		eout, stderr, err := run("env", "-json", "GOCACHE", "GOPROXY", "GOROOT", "GOVERSION")
+		if err != nil {
+			return fmt.Errorf("failed to determine environment from go command: %v\n%v", err, stderr.String())
+		}
+		if err := json.Unmarshal(eout.Bytes(), tc); err != nil {
+			return fmt.Errorf("failed to unmarshal environment from go command out: %v\n%s", err, eout)
+		}
 	}
-	version := goEnv.releaseTags[len(goEnv.releaseTags)-1]
+	version := tc.releaseTags[len(tc.releaseTags)-1]
 	if !goVersionRegex.MatchString(version) {
 		return fmt.Errorf("invalid go version %q", version)
 	}
-	goEnv.goversion = version[2:]
+	tc.goversion = version[2:]
 
 	return nil
 }
 
 // Setup sets up the given test environment for tests that use the go
-// command. It adds support for go tags to p.Condition and adds the go
-// command to p.Cmds. It also wraps p.Setup to set up the environment
+// command. It adds the go command to p.Commands, along with the gotest,
+// testresult and testoutput commands for checking the outcome of go test
+// runs, which are only added if p.Commands does not already have commands
+// with those names. It also wraps p.Setup to set up the environment
 // variables for running the go command appropriately.
 //
 // It checks go command can run, but not that it can build or run
@@ -100,34 +133,54 @@ func Setup(p *testscript.Params) error {
 	if goEnv.err != nil {
 		return goEnv.err
 	}
+	goEnv.toolchain.setup(p)
+	return nil
+}
 
+// setup adds the go command to p, running the toolchain.
+func (tc *toolchain) setup(p *testscript.Params) {
 	origSetup := p.Setup
 	p.Setup = func(e *testscript.Env) error {
-		e.Vars = goEnviron(e.Vars)
+		e.Vars = tc.environ(e.Vars)
+		e.Values[gotestKey{}] = new(gotestResults)
 		if origSetup != nil {
 			return origSetup(e)
 		}
 		return nil
 	}
-	if p.Cmds == nil {
-		p.Cmds = make(map[string]func(ts *testscript.TestScript, neg bool, args []string))
+	if p.Commands == nil {
+		p.Commands = make(map[string]testscript.Cmd)
+	}
+	p.Commands["go"] = testscript.Cmd{
+		Run:       cmdGo,
+		Args:      "subcommand [args...]",
+		Summary:   "Run the go command with the given arguments.",
+		Negatable: true,
+		Detail: `The go command runs with GOPATH set to $WORK/.gopath and with GOROOT,
+GOCACHE and GOPROXY taken from the go command found when the test started.`,
+	}
+	for name, cmd := range gotestCmds {
+		if _, ok := p.Commands[name]; !ok {
+			p.Commands[name] = cmd
+		}
 	}
-	p.Cmds["go"] = cmdGo
-	return nil
 }
 
-func goEnviron(env0 []string) []string {
+func (tc *toolchain) environ(env0 []string) []string {
 	env := environ(env0)
 	workdir := env.get("WORK")
+	if tc.bin != "" {
+		env = append(toolchainEnviron(env), "PATH="+tc.bin+string(filepath.ListSeparator)+env.get("PATH"))
+	}
 	return append(env, []string{
 		"GOPATH=" + filepath.Join(workdir, ".gopath"),
 		"CCACHE_DISABLE=1", // ccache breaks with non-existent HOME
 		"GOARCH=" + runtime.GOARCH,
 		"GOOS=" + runtime.GOOS,
-		"GOROOT=" + goEnv.GOROOT,
-		"GOCACHE=" + goEnv.GOCACHE,
-		"GOPROXY=" + goEnv.GOPROXY,
-		"goversion=" + goEnv.goversion,
+		"GOROOT=" + tc.GOROOT,
+		"GOCACHE=" + tc.GOCACHE,
+		"GOPROXY=" + tc.GOPROXY,
+		"goversion=" + tc.goversion,
 	}...)
 }
 
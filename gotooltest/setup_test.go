@@ -3,6 +3,8 @@ package gotooltest
 import (
 	"os"
 	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
 )
 
 func TestInitGoEnv(t *testing.T) {
@@ -28,3 +30,20 @@ func TestInitGoEnv(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSetupKeepsCommands(t *testing.T) {
+	p := testscript.Params{
+		Commands: map[string]testscript.Cmd{
+			"gotest": {Summary: "mine"},
+		},
+	}
+	if err := Setup(&p); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Commands["gotest"].Summary; got != "mine" {
+		t.Errorf("gotest command was replaced; got summary %q", got)
+	}
+	if _, ok := p.Commands["testresult"]; !ok {
+		t.Errorf("testresult command was not added")
+	}
+}
@@ -0,0 +1,145 @@
+package gotooltest
+
+import (
+	"go/version"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// toolchains caches the probed toolchains, keyed by GOROOT.
+var toolchains struct {
+	mu    sync.Mutex
+	byDir map[string]*toolchainResult
+}
+
+type toolchainResult struct {
+	tc  toolchain
+	err error
+}
+
+// loadToolchain returns the toolchain installed in goroot,
+// probing it the first time it is used.
+func loadToolchain(goroot string) (*toolchain, error) {
+	goroot, err := filepath.Abs(goroot)
+	if err != nil {
+		return nil, err
+	}
+	toolchains.mu.Lock()
+	defer toolchains.mu.Unlock()
+	r, ok := toolchains.byDir[goroot]
+	if !ok {
+		r = &toolchainResult{}
+		r.tc.bin = filepath.Join(goroot, "bin")
+		r.err = probeToolchain(&r.tc, filepath.Join(r.tc.bin, "go"+exeSuffix()))
+		if toolchains.byDir == nil {
+			toolchains.byDir = make(map[string]*toolchainResult)
+		}
+		toolchains.byDir[goroot] = r
+	}
+	return &r.tc, r.err
+}
+
+// toolchainEnviron returns env with the variables that would
+// stop a toolchain from using its own GOROOT and version removed,
+// and with GOTOOLCHAIN set so that it never switches to another.
+func toolchainEnviron(env []string) []string {
+	env = slices.DeleteFunc(slices.Clone(env), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return name == "GOROOT" || name == "GOTOOLCHAIN"
+	})
+	return append(env, "GOTOOLCHAIN=local")
+}
+
+// SetupToolchain is like Setup, except that scripts use the Go
+// toolchain installed in goroot rather than the go command found in
+// PATH. The toolchain's bin directory is added to the front of PATH
+// for the scripts, and p.ReleaseTags is set so that [go1.x]
+// conditions reflect the toolchain's Go version.
+func SetupToolchain(p *testscript.Params, goroot string) error {
+	tc, err := loadToolchain(goroot)
+	if err != nil {
+		return err
+	}
+	p.ReleaseTags = tc.releaseTags
+	tc.setup(p)
+	return nil
+}
+
+// RunToolchains runs the scripts described by p once for each of the
+// Go toolchains installed in the given GOROOT directories, set up as
+// by SetupToolchain. The scripts for each toolchain run in a subtest
+// named after its Go version, for example "go1.22.5". If no
+// directories are given, the toolchains found by SDKToolchains are used.
+func RunToolchains(t *testing.T, p testscript.Params, goroots ...string) {
+	if len(goroots) == 0 {
+		var err error
+		goroots, err = SDKToolchains()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(goroots) == 0 {
+			t.Fatal("no Go toolchains found in $HOME/sdk")
+		}
+	}
+	for _, goroot := range goroots {
+		tc, err := loadToolchain(goroot)
+		if err != nil {
+			t.Fatalf("cannot use Go toolchain in %s: %v", goroot, err)
+		}
+		name := tc.GOVERSION
+		if name == "" {
+			name = filepath.Base(goroot)
+		}
+		t.Run(name, func(t *testing.T) {
+			p := p
+			p.Commands = maps.Clone(p.Commands)
+			if err := SetupToolchain(&p, goroot); err != nil {
+				t.Fatal(err)
+			}
+			testscript.Run(t, p)
+		})
+	}
+}
+
+// SDKToolchains returns the GOROOT directories of the Go toolchains
+// installed in $HOME/sdk, as done by the golang.org/dl commands,
+// with the newest version first.
+func SDKToolchains() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob(filepath.Join(home, "sdk", "go1.*"))
+	if err != nil {
+		return nil, err
+	}
+	var goroots []string
+	for _, dir := range dirs {
+		if !version.IsValid(filepath.Base(dir)) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "bin", "go"+exeSuffix())); err != nil {
+			continue
+		}
+		goroots = append(goroots, dir)
+	}
+	slices.SortFunc(goroots, func(a, b string) int {
+		return version.Compare(filepath.Base(b), filepath.Base(a))
+	})
+	return goroots, nil
+}
+
+func exeSuffix() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
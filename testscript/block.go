@@ -0,0 +1,165 @@
+package testscript
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type stmtKind int
+
+const (
+	stmtLine    stmtKind = iota // a command line, possibly blank
+	stmtComment                 // a # phase comment
+	stmtIf                      // an if [cond] ... else ... end block
+	stmtRetry                   // a retry N interval ... end block
+)
+
+// scriptStmt holds a statement in a script: a single line or a block
+// containing further statements.
+type scriptStmt struct {
+	kind   stmtKind
+	lineno int
+	line   string // text of the line, or of the opening line of a block
+
+	body       []*scriptStmt // statements inside the block
+	elseLineno int           // line number of an if block's else, or 0
+	elseBody   []*scriptStmt // statements after the else of an if block
+}
+
+// parseScript splits the script into statements, matching each if and
+// retry line with its end line. Block structure errors are reported
+// with ts.Fatalf.
+func (ts *TestScript) parseScript(script string) []*scriptStmt {
+	type frame struct {
+		st     *scriptStmt
+		inElse bool
+	}
+	var (
+		top   []*scriptStmt
+		stack []*frame
+	)
+	add := func(st *scriptStmt) {
+		if len(stack) == 0 {
+			top = append(top, st)
+			return
+		}
+		f := stack[len(stack)-1]
+		if f.inElse {
+			f.st.elseBody = append(f.st.elseBody, st)
+		} else {
+			f.st.body = append(f.st.body, st)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(script, "\n"), "\n")
+	for i, line := range lines {
+		ts.lineno = i + 1
+		st := &scriptStmt{
+			kind:   stmtLine,
+			lineno: ts.lineno,
+			line:   line,
+		}
+		if strings.HasPrefix(line, "#") {
+			st.kind = stmtComment
+			add(st)
+			continue
+		}
+		if len(stack) > 0 {
+			// Lines inside blocks are conventionally indented;
+			// don't show the indentation in the log.
+			st.line = strings.TrimLeft(line, " \t")
+		}
+		var word string
+		if fields := strings.Fields(line); len(fields) > 0 {
+			word = fields[0]
+		}
+		switch word {
+		case "if":
+			st.kind = stmtIf
+			add(st)
+			stack = append(stack, &frame{st: st})
+		case "retry":
+			st.kind = stmtRetry
+			add(st)
+			stack = append(stack, &frame{st: st})
+		case "else":
+			ts.checkBlockEnd(line, "else")
+			if len(stack) == 0 || stack[len(stack)-1].st.kind != stmtIf || stack[len(stack)-1].inElse {
+				ts.Fatalf("else without matching if")
+			}
+			f := stack[len(stack)-1]
+			f.inElse = true
+			f.st.elseLineno = ts.lineno
+		case "end":
+			ts.checkBlockEnd(line, "end")
+			if len(stack) == 0 {
+				ts.Fatalf("end without matching if or retry")
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			add(st)
+		}
+	}
+	if len(stack) > 0 {
+		st := stack[len(stack)-1].st
+		ts.lineno = st.lineno
+		ts.Fatalf("missing end for %s", strings.Fields(st.line)[0])
+	}
+	return top
+}
+
+// checkBlockEnd checks that an else or end line has no arguments.
+func (ts *TestScript) checkBlockEnd(line, word string) {
+	if args := ts.parse(line); len(args) != 1 {
+		ts.Fatalf("usage: %s", word)
+	}
+}
+
+// runIf logs the opening line of an if block and evaluates its
+// condition. It reports whether the body of the block should be run,
+// and whether the line succeeded.
+func (ts *TestScript) runIf(line string) (taken, runOK bool) {
+	defer catchFailNow(func() {
+		runOK = false
+	})
+	fmt.Fprintf(&ts.log, "> %s\n", line)
+	args := ts.parse(line)
+	cond := strings.Join(args[1:], " ")
+	if !strings.HasPrefix(cond, "[") || !strings.HasSuffix(cond, "]") {
+		ts.Fatalf("usage: if [cond]")
+	}
+	cond = strings.TrimSpace(cond[1 : len(cond)-1])
+	expr, err := parseCondExpr(cond)
+	if err != nil {
+		ts.Fatalf("bad condition %q: %v", cond, err)
+	}
+	taken, err = ts.evalCond(expr)
+	if err != nil {
+		ts.Fatalf("bad condition %q: %v", cond, err)
+	}
+	return taken, true
+}
+
+// runRetry logs the opening line of a retry block and returns the
+// maximum number of attempts and the interval between them, and
+// whether the line succeeded.
+func (ts *TestScript) runRetry(line string) (attempts int, interval time.Duration, runOK bool) {
+	defer catchFailNow(func() {
+		runOK = false
+	})
+	fmt.Fprintf(&ts.log, "> %s\n", line)
+	args := ts.parse(line)
+	if len(args) != 3 {
+		ts.Fatalf("usage: retry attempts interval")
+	}
+	attempts, err := strconv.Atoi(args[1])
+	if err != nil || attempts < 1 {
+		ts.Fatalf("invalid retry attempts %q: must be a positive integer", args[1])
+	}
+	interval, err = time.ParseDuration(args[2])
+	if err != nil || interval < 0 {
+		ts.Fatalf("invalid retry interval %q", args[2])
+	}
+	return attempts, interval, true
+}
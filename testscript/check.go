@@ -0,0 +1,169 @@
+package testscript
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScriptError describes a problem found by [Params.CheckScript].
+type ScriptError struct {
+	// Line holds the line number of the problem within the script.
+	Line int
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e ScriptError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Line, e.Msg)
+}
+
+// CheckScript checks a script, the comment section of a txtar archive,
+// without running any of it, returning any problems found in line
+// order. It reports mismatched blocks, badly quoted arguments,
+// malformed conditions, unknown commands, and commands used with the
+// wrong number of arguments or with an unsupported ! prefix, as
+// described by [Params.AllCmds]. Unknown conditions are only reported
+// when p.Condition is nil, as the conditions that it supports cannot be
+// listed.
+//
+// Environment variables are not expanded, so the name of a command
+// given by a variable is not checked.
+func (p *Params) CheckScript(script string) []ScriptError {
+	ts := &TestScript{
+		params: *p,
+		file:   "script",
+		envMap: make(map[string]string),
+	}
+	var errs []ScriptError
+	// check calls f, recording the message given to Fatalf
+	// if it fails.
+	check := func(f func() bool) bool {
+		ts.log.Reset()
+		ok := false
+		func() {
+			defer catchFailNow(func() {})
+			ok = f()
+		}()
+		if !ok {
+			prefix := fmt.Sprintf("FAIL: %s:%d: ", ts.file, ts.lineno)
+			for _, line := range strings.Split(ts.log.String(), "\n") {
+				if msg, found := strings.CutPrefix(line, prefix); found {
+					errs = append(errs, ScriptError{Line: ts.lineno, Msg: msg})
+				}
+			}
+		}
+		return ok
+	}
+	var stmts []*scriptStmt
+	if !check(func() bool {
+		stmts = ts.parseScript(script)
+		return true
+	}) {
+		return errs
+	}
+	var checkStmts func(stmts []*scriptStmt)
+	checkStmts = func(stmts []*scriptStmt) {
+		for _, st := range stmts {
+			ts.lineno = st.lineno
+			switch st.kind {
+			case stmtLine:
+				check(func() bool {
+					ts.checkLine(st.line)
+					return true
+				})
+			case stmtIf:
+				check(func() bool {
+					ts.checkIf(st.line)
+					return true
+				})
+				checkStmts(st.body)
+				checkStmts(st.elseBody)
+			case stmtRetry:
+				check(func() bool {
+					_, _, ok := ts.runRetry(st.line)
+					return ok
+				})
+				checkStmts(st.body)
+			}
+		}
+	}
+	checkStmts(stmts)
+	return errs
+}
+
+// checkLine checks a line in the same way as runLine,
+// but without running anything.
+func (ts *TestScript) checkLine(line string) {
+	args := ts.parse(line)
+	if len(args) == 0 {
+		return
+	}
+	for strings.HasPrefix(args[0], "[") {
+		var cond string
+		cond, args = ts.cutCond(args)
+		ts.checkCond(cond)
+	}
+	neg := false
+	if args[0] == "!" {
+		neg = true
+		args = args[1:]
+		if len(args) == 0 {
+			ts.Fatalf("! on line by itself")
+		}
+	}
+	if args[0] == "" || strings.HasPrefix(strings.TrimLeft(line, " \t!"), "$") {
+		// The command name comes from an environment variable.
+		return
+	}
+	cmd, ok := ts.lookupCmd(args[0])
+	if !ok {
+		ts.unknownCmd(args[0])
+	}
+	ts.checkUsage(args[0], cmd, neg, args[1:])
+}
+
+// checkIf checks the opening line of an if block
+// in the same way as runIf, without evaluating it.
+func (ts *TestScript) checkIf(line string) {
+	args := ts.parse(line)
+	cond := strings.Join(args[1:], " ")
+	if !strings.HasPrefix(cond, "[") || !strings.HasSuffix(cond, "]") {
+		ts.Fatalf("usage: if [cond]")
+	}
+	ts.checkCond(strings.TrimSpace(cond[1 : len(cond)-1]))
+}
+
+// checkCond checks that the condition expression is well formed
+// and, unless Params.Condition is set, that the conditions it
+// uses are known.
+func (ts *TestScript) checkCond(cond string) {
+	expr, err := parseCondExpr(cond)
+	if err != nil {
+		ts.Fatalf("bad condition %q: %v", cond, err)
+	}
+	if ts.params.Condition != nil {
+		return
+	}
+	var walk func(e *condExpr)
+	walk = func(e *condExpr) {
+		if e == nil {
+			return
+		}
+		if e.op == "" && !ts.knownCond(e.name) {
+			ts.Fatalf("unknown condition %q", e.name)
+		}
+		walk(e.x)
+		walk(e.y)
+	}
+	walk(expr)
+}
+
+// knownCond reports whether cond is one of the built-in conditions
+// or is provided by Params.Conditions.
+func (ts *TestScript) knownCond(cond string) bool {
+	if _, ok := ts.builtinCond(cond); ok {
+		return true
+	}
+	_, _, ok := ts.lookupCond(cond)
+	return ok
+}
@@ -1,10 +1,18 @@
-//go:build unix && !darwin
+//go:build unix && !darwin && !linux
 
 package testscript
 
-import "os"
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
 
-// cloneFile makes a clone of a file via a hard link.
-func cloneFile(from, to string) error {
-	return os.Link(from, to)
+// cloneFile makes a clone of a file via a hard link, when hardLink
+// allows it, as there is no known way to make copy-on-write clones.
+func cloneFile(from, to string, perm fs.FileMode, hardLink bool) error {
+	if hardLink {
+		return os.Link(from, to)
+	}
+	return fmt.Errorf("unavailable")
 }
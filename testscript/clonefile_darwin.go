@@ -1,8 +1,13 @@
 package testscript
 
-import "golang.org/x/sys/unix"
+import (
+	"io/fs"
 
-// cloneFile makes a clone of a file via MacOS's `clonefile` syscall.
-func cloneFile(from, to string) error {
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes a copy-on-write clone of a file via MacOS's `clonefile`
+// syscall, which preserves the file's permissions.
+func cloneFile(from, to string, perm fs.FileMode, hardLink bool) error {
 	return unix.Clonefile(from, to, 0)
 }
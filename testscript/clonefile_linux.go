@@ -0,0 +1,39 @@
+package testscript
+
+import (
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes a copy-on-write clone of a file via the FICLONE ioctl,
+// which is supported by file systems such as Btrfs and XFS. On other file
+// systems, it falls back to a hard link when hardLink allows it.
+func cloneFile(from, to string, perm fs.FileMode, hardLink bool) error {
+	err := ioctlClone(from, to, perm)
+	if err != nil && hardLink {
+		return os.Link(from, to)
+	}
+	return err
+}
+
+func ioctlClone(from, to string, perm fs.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+	}
+	return err
+}
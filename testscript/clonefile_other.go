@@ -2,11 +2,14 @@
 
 package testscript
 
-import "fmt"
+import (
+	"fmt"
+	"io/fs"
+)
 
 // cloneFile does not attempt anything on Windows, as hard links on it have
 // led to "access denied" errors when deleting files at the end of a test.
 // We haven't tested platforms like plan9 or wasm/wasi.
-func cloneFile(from, to string) error {
+func cloneFile(from, to string, perm fs.FileMode, hardLink bool) error {
 	return fmt.Errorf("unavailable")
 }
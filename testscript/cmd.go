@@ -7,7 +7,9 @@ package testscript
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,31 +28,207 @@ import (
 // Keep list and the implementations below sorted by name.
 //
 // NOTE: If you make changes here, update doc.go.
-var scriptCmds = map[string]func(*TestScript, bool, []string){
-	"cd":       (*TestScript).cmdCd,
-	"chmod":    (*TestScript).cmdChmod,
-	"cmp":      (*TestScript).cmdCmp,
-	"cmpenv":   (*TestScript).cmdCmpenv,
-	"cp":       (*TestScript).cmdCp,
-	"env":      (*TestScript).cmdEnv,
-	"exec":     (*TestScript).cmdExec,
-	"exists":   (*TestScript).cmdExists,
-	"grep":     (*TestScript).cmdGrep,
-	"kill":     (*TestScript).cmdKill,
-	"mkdir":    (*TestScript).cmdMkdir,
-	"mv":       (*TestScript).cmdMv,
-	"rm":       (*TestScript).cmdRm,
-	"skip":     (*TestScript).cmdSkip,
-	"stderr":   (*TestScript).cmdStderr,
-	"stdin":    (*TestScript).cmdStdin,
-	"stdout":   (*TestScript).cmdStdout,
-	"ttyin":    (*TestScript).cmdTtyin,
-	"ttyout":   (*TestScript).cmdTtyout,
-	"stop":     (*TestScript).cmdStop,
-	"symlink":  (*TestScript).cmdSymlink,
-	"unix2dos": (*TestScript).cmdUNIX2DOS,
-	"unquote":  (*TestScript).cmdUnquote,
-	"wait":     (*TestScript).cmdWait,
+var scriptCmds = map[string]Cmd{
+	"cd": {
+		Run:     (*TestScript).cmdCd,
+		Args:    "dir",
+		Summary: "Change to the given directory for future commands.",
+	},
+	"chmod": {
+		Run:     (*TestScript).cmdChmod,
+		Args:    "perm path...",
+		Summary: "Change the permissions of files or directories to the given octal mode.",
+	},
+	"cmp": {
+		Run:       (*TestScript).cmdCmp,
+		Args:      "file1 file2",
+		Summary:   "Check that the named files have the same content.",
+		Negatable: true,
+		Detail: `By convention, file1 is the actual data and file2 the expected data.
+File1 can be "stdout" or "stderr" to use the standard output or standard error
+from the most recent exec or wait command.`,
+	},
+	"cmpenv": {
+		Run:       (*TestScript).cmdCmpenv,
+		Args:      "file1 file2",
+		Summary:   "Like cmp, but environment variables in file2 are substituted first.",
+		Negatable: true,
+	},
+	"cp": {
+		Run:     (*TestScript).cmdCp,
+		Args:    "src... dst",
+		Summary: "Copy the listed files to the target file or existing directory.",
+	},
+	"env": {
+		Run:     (*TestScript).cmdEnv,
+		Args:    "[-unset] [key=value...]",
+		Summary: "Print the environment, or add the listed key=value pairs to it.",
+		Flags: []CmdFlag{
+			{"-unset", "remove the named variables from the environment"},
+		},
+	},
+	"exec": {
+		Run:       (*TestScript).cmdExec,
+		Args:      "[-env=key=value...] [-rlimit=limits] program [args...] [&]",
+		Summary:   "Run the given executable program with the arguments.",
+		Negatable: true,
+		Detail: `If the last token is '&' or '&name&', the program runs in the background
+and its exit status is checked by a later 'wait'.`,
+		Flags: []CmdFlag{
+			{"-env=key=value", "set an environment variable for this command only"},
+			{"-rlimit=limits", "limit the resources used by the program, for example as=512M,cpu=10s,nofile=64 (Linux only)"},
+		},
+	},
+	"exists": {
+		Run:       (*TestScript).cmdExists,
+		Args:      "[-readonly] file...",
+		Summary:   "Check that each of the listed files or directories exists.",
+		Negatable: true,
+		Flags: []CmdFlag{
+			{"-readonly", "require the files or directories to be unwritable"},
+		},
+	},
+	"grep": {
+		Run:       (*TestScript).cmdGrep,
+		Args:      "[-count=N] [-exact] pattern file",
+		Summary:   "Check that the file's content matches the regular expression pattern.",
+		Negatable: true,
+		Flags: []CmdFlag{
+			{"-count=N", "require exactly N matches"},
+			{"-exact", "match pattern as literal text rather than a regular expression"},
+		},
+	},
+	"kill": {
+		Run:     (*TestScript).cmdKill,
+		Args:    "[-SIGNAL] [name]",
+		Summary: "Terminate background commands, or only the named one.",
+		Flags: []CmdFlag{
+			{"-SIGNAL", "the signal to send, such as TERM or HUP; KILL is the default"},
+		},
+	},
+	"mkdir": {
+		Run:     (*TestScript).cmdMkdir,
+		Args:    "path...",
+		Summary: "Create the listed directories, if they do not already exist.",
+	},
+	"mv": {
+		Run:     (*TestScript).cmdMv,
+		Args:    "old new",
+		Summary: "Rename a file or directory.",
+	},
+	"rm": {
+		Run:     (*TestScript).cmdRm,
+		Args:    "file...",
+		Summary: "Remove the listed files or directories.",
+	},
+	"skip": {
+		Run:     (*TestScript).cmdSkip,
+		Args:    "[message]",
+		Summary: "Mark the test skipped, including the message if given.",
+	},
+	"stat": {
+		Run:       (*TestScript).cmdStat,
+		Args:      "[-type=T] [-target=path] [-perm=mode] [-size=N] [-lines=N] [-newer=file] [-older=file] path...",
+		Summary:   "Check the metadata of each of the listed files or directories.",
+		Negatable: true,
+		Detail: `The files must exist. When negated, at least one of the checks
+must fail for each path. The -size and -lines flags accept a
+comparison such as <N, <=N, >N or >=N instead of an exact count.`,
+		Flags: []CmdFlag{
+			{"-type=T", "require the type to be file, dir or symlink"},
+			{"-target=path", "require a symlink with the given target"},
+			{"-perm=mode", "require the given octal permission bits, for example 0755"},
+			{"-size=N", "require a size of N bytes"},
+			{"-lines=N", "require a file with N lines"},
+			{"-newer=file", "require a modification time after that of file"},
+			{"-older=file", "require a modification time before that of file"},
+		},
+	},
+	"stderr": {
+		Run:       (*TestScript).cmdStderr,
+		Args:      "[-count=N] [-exact] pattern",
+		Summary:   "Check that the standard error of the most recent command matches pattern.",
+		Negatable: true,
+		Flags: []CmdFlag{
+			{"-count=N", "require exactly N matches"},
+			{"-exact", "match pattern as literal text rather than a regular expression"},
+		},
+	},
+	"stdin": {
+		Run:     (*TestScript).cmdStdin,
+		Args:    "file",
+		Summary: "Set the standard input for the next exec command.",
+	},
+	"stdout": {
+		Run:       (*TestScript).cmdStdout,
+		Args:      "[-count=N] [-exact] pattern",
+		Summary:   "Check that the standard output of the most recent command matches pattern.",
+		Negatable: true,
+		Flags: []CmdFlag{
+			{"-count=N", "require exactly N matches"},
+			{"-exact", "match pattern as literal text rather than a regular expression"},
+		},
+	},
+	"ttyin": {
+		Run:     (*TestScript).cmdTtyin,
+		Args:    "[-stdin] file",
+		Summary: "Attach the next exec command to a pseudo-terminal fed from file.",
+		Flags: []CmdFlag{
+			{"-stdin", "also attach the terminal to standard input"},
+		},
+	},
+	"ttyout": {
+		Run:       (*TestScript).cmdTtyout,
+		Args:      "[-count=N] [-exact] pattern",
+		Summary:   "Check that the terminal output of the most recent command matches pattern.",
+		Negatable: true,
+		Flags: []CmdFlag{
+			{"-count=N", "require exactly N matches"},
+			{"-exact", "match pattern as literal text rather than a regular expression"},
+		},
+	},
+	"stop": {
+		Run:     (*TestScript).cmdStop,
+		Args:    "[message]",
+		Summary: "Stop the test early, marking it as passing.",
+	},
+	"symlink": {
+		Run:     (*TestScript).cmdSymlink,
+		Args:    "file -> target",
+		Summary: "Create file as a symlink to target.",
+	},
+	"unix2dos": {
+		Run:     (*TestScript).cmdUNIX2DOS,
+		Args:    "path...",
+		Summary: "Convert files from UNIX line endings to DOS line endings.",
+	},
+	"unquote": {
+		Run:     (*TestScript).cmdUnquote,
+		Args:    "file...",
+		Summary: "Remove the leading \">\" quoting from each line of the files.",
+	},
+	"wait": {
+		Run:     (*TestScript).cmdWait,
+		Args:    "[-exit=N | -signal=SIGNAL] [name]",
+		Summary: "Wait for background commands, or only the named one, to exit.",
+		Flags: []CmdFlag{
+			{"-exit=N", "require the named command to exit with status N"},
+			{"-signal=SIGNAL", "require the named command to be terminated by SIGNAL"},
+		},
+	},
+}
+
+func init() {
+	// defer refers to scriptCmds when it runs,
+	// so add it here to avoid an initialization cycle.
+	scriptCmds["defer"] = Cmd{
+		Run:     (*TestScript).cmdDefer,
+		Args:    "command [args...]",
+		Summary: "Queue a command to run when the script ends, even if it fails.",
+		Detail: `Deferred commands run in the reverse order to which they were queued.
+The command may be negated, as in 'defer ! exec prog'. Its arguments are
+expanded when the defer command runs.`,
+	}
 }
 
 // cd changes to a different directory.
@@ -119,7 +297,14 @@ func (ts *TestScript) doCmdCmp(neg bool, args []string, env bool) {
 	text1 := ts.ReadFile(name1)
 
 	absName2 := ts.MkAbs(name2)
+	// Expected files are not updated by retry attempts that will be run
+	// again, as a later attempt may yet match them.
+	update := ts.params.UpdateScripts && !env && !ts.tentative
 	data, err := os.ReadFile(absName2)
+	if errors.Is(err, fs.ErrNotExist) && update && !neg {
+		ts.updateGolden(name2, absName2, text1)
+		return
+	}
 	ts.Check(err)
 	text2 := string(data)
 	if env {
@@ -135,13 +320,21 @@ func (ts *TestScript) doCmdCmp(neg bool, args []string, env bool) {
 	if eq {
 		return // they are equal, as expected
 	}
-	if ts.params.UpdateScripts && !env {
+	if update {
 		if scriptFile, ok := ts.scriptFiles[absName2]; ok {
 			ts.scriptUpdates[scriptFile] = text1
 			return
 		}
-		// The file being compared against isn't in the txtar archive, so don't
-		// update the script.
+		switch {
+		case ts.inScriptDir(absName2):
+			ts.updateGolden(name2, absName2, text1)
+			return
+		case !ts.inWorkdir(absName2):
+			ts.Logf("not updating %s: only files in $SCRIPTDIR are updated in place", name2)
+		}
+		// Otherwise the file being compared against was created by the
+		// script rather than coming from the txtar archive, so don't
+		// update it.
 	}
 
 	unifiedDiff := diff.Diff(name1, []byte(text1), name2, []byte(text2))
@@ -150,6 +343,69 @@ func (ts *TestScript) doCmdCmp(neg bool, args []string, env bool) {
 	ts.Fatalf("%s and %s differ", name1, name2)
 }
 
+// updateGolden writes the expected contents of a file compared
+// against by cmp in UpdateScripts mode. A missing file in the work
+// directory is added to the txtar archive; a file in the script's
+// directory is written in place. Any other file is left alone, so
+// that updating scripts cannot overwrite files elsewhere.
+func (ts *TestScript) updateGolden(name, absName, content string) {
+	if !ts.inWorkdir(absName) {
+		if !ts.inScriptDir(absName) {
+			ts.Fatalf("cannot create %s: only files in $WORK or $SCRIPTDIR are updated", name)
+		}
+		ts.Check(os.MkdirAll(filepath.Dir(absName), 0o777))
+		ts.Check(os.WriteFile(absName, []byte(content), 0o666))
+		ts.Logf("%s updated", name)
+		return
+	}
+	rel, err := filepath.Rel(ts.workdir, absName)
+	ts.Check(err)
+	rel = filepath.ToSlash(rel)
+	ts.archive.Files = append(ts.archive.Files, txtar.File{Name: rel})
+	ts.scriptFiles[absName] = rel
+	ts.scriptUpdates[rel] = content
+	// Later commands may use the file too.
+	ts.Check(os.MkdirAll(filepath.Dir(absName), 0o777))
+	ts.Check(os.WriteFile(absName, []byte(content), 0o666))
+}
+
+// inWorkdir reports whether the absolute path name is
+// within the script's work directory.
+func (ts *TestScript) inWorkdir(name string) bool {
+	rel, err := filepath.Rel(ts.workdir, name)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// inScriptDir reports whether the absolute path name is within the
+// directory containing the script, after resolving any symbolic
+// links in the existing part of the path.
+func (ts *TestScript) inScriptDir(name string) bool {
+	dir, err := filepath.Abs(filepath.Dir(ts.file))
+	if err != nil {
+		return false
+	}
+	if d, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = d
+	}
+	// Resolve the longest existing prefix of name,
+	// which may not exist yet.
+	resolved, rest := name, ""
+	for {
+		if r, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = filepath.Join(r, rest)
+			break
+		}
+		parent := filepath.Dir(resolved)
+		if parent == resolved {
+			break
+		}
+		rest = filepath.Join(filepath.Base(resolved), rest)
+		resolved = parent
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	return err == nil && filepath.IsLocal(rel)
+}
+
 // cp copies files, maybe eventually directories.
 func (ts *TestScript) cmdCp(neg bool, args []string) {
 	if neg {
@@ -201,11 +457,70 @@ func (ts *TestScript) cmdCp(neg bool, args []string) {
 	}
 }
 
-// env displays or adds to the environment.
+// defer queues a command to run at the end of the script.
+func (ts *TestScript) cmdDefer(neg bool, args []string) {
+	cmdNeg := false
+	if args[0] == "!" {
+		cmdNeg = true
+		args = args[1:]
+		if len(args) == 0 {
+			ts.Fatalf("usage: defer command [args...]")
+		}
+	}
+	name, cmdArgs := args[0], args[1:]
+	if name == "defer" {
+		ts.Fatalf("cannot defer defer")
+	}
+	cmd, ok := ts.lookupCmd(name)
+	if !ok {
+		ts.Fatalf("unknown command %q", name)
+	}
+	// Check the usage now so that mistakes are attributed
+	// to the defer line rather than reported at the end.
+	ts.checkUsage(name, cmd, cmdNeg, cmdArgs)
+	lineno := ts.lineno
+	ts.Defer(func() {
+		ts.lineno = lineno
+		if !ts.runDeferredCmd(cmd, cmdNeg, args) {
+			ts.deferFailed = true
+		}
+	})
+}
+
+// runDeferredCmd runs a command queued by defer,
+// reporting whether it succeeded.
+func (ts *TestScript) runDeferredCmd(cmd Cmd, neg bool, args []string) (runOK bool) {
+	defer catchFailNow(func() {
+		runOK = false
+	})
+	line := strings.Join(args, " ")
+	if neg {
+		line = "! " + line
+	}
+	fmt.Fprintf(&ts.log, "> [deferred] %s\n", line)
+	ts.callBuiltinCmd(func() {
+		cmd.Run(ts, neg, args[1:])
+	})
+	return true
+}
+
+// env displays, adds to or removes from the environment.
 func (ts *TestScript) cmdEnv(neg bool, args []string) {
 	if neg {
 		ts.Fatalf("unsupported: ! env")
 	}
+	if len(args) > 0 && args[0] == "-unset" {
+		if len(args) == 1 {
+			ts.Fatalf("usage: env -unset name...")
+		}
+		for _, name := range args[1:] {
+			if name == "" || strings.Contains(name, "=") {
+				ts.Fatalf("invalid environment variable name %q", name)
+			}
+			ts.Unsetenv(name)
+		}
+		return
+	}
 	if len(args) == 0 {
 		printed := make(map[string]bool) // env list can have duplicates; only print effective value (from envMap) once
 		for _, kv := range ts.env {
@@ -232,8 +547,41 @@ var backgroundSpecifier = regexp.MustCompile(`^&([a-zA-Z_0-9]+&)?$`)
 
 // exec runs the given command.
 func (ts *TestScript) cmdExec(neg bool, args []string) {
+	// Leading -env=key=value flags set environment
+	// variables for this command only.
+	var vars []string
+	for len(args) > 0 {
+		if kv, ok := strings.CutPrefix(args[0], "-env="); ok {
+			if before, _, ok := strings.Cut(kv, "="); !ok || before == "" {
+				ts.Fatalf("invalid flag %q: want -env=key=value", args[0])
+			}
+			vars = append(vars, kv)
+		} else if spec, ok := strings.CutPrefix(args[0], "-rlimit="); ok {
+			limits, err := parseRlimits(spec)
+			if err != nil {
+				ts.Fatalf("invalid flag %q: %v", args[0], err)
+			}
+			ts.rlimits = append(ts.rlimits, limits...)
+			defer func() {
+				ts.rlimits = nil
+			}()
+		} else {
+			break
+		}
+		args = args[1:]
+	}
+	if len(vars) > 0 {
+		ts.WithEnv(vars, func() {
+			ts.doCmdExec(neg, args)
+		})
+		return
+	}
+	ts.doCmdExec(neg, args)
+}
+
+func (ts *TestScript) doCmdExec(neg bool, args []string) {
 	if len(args) < 1 || (len(args) == 1 && args[0] == "&") {
-		ts.Fatalf("usage: exec program [args...] [&]")
+		ts.Fatalf("usage: exec [-env=key=value...] [-rlimit=limits] program [args...] [&]")
 	}
 
 	var err error
@@ -243,14 +591,15 @@ func (ts *TestScript) cmdExec(neg bool, args []string) {
 			ts.Fatalf("duplicate background process name %q", bgName)
 		}
 		var cmd *exec.Cmd
-		cmd, err = ts.execBackground(args[0], args[1:len(args)-1]...)
+		var g *procGroup
+		cmd, g, err = ts.execBackground(args[0], args[1:len(args)-1]...)
 		if err == nil {
 			wait := make(chan struct{})
 			go func() {
-				waitOrStop(ts.ctxt, cmd, -1)
+				waitOrStop(ts.ctxt, cmd, g, -1)
 				close(wait)
 			}()
-			ts.background = append(ts.background, backgroundCmd{bgName, cmd, wait, neg})
+			ts.background = append(ts.background, backgroundCmd{bgName, cmd, g, wait, neg, len(ts.rlimits) > 0})
 		}
 		ts.stdout, ts.stderr = "", ""
 	} else {
@@ -372,7 +721,7 @@ func (ts *TestScript) cmdSkip(neg bool, args []string) {
 	// Before we mark the test as skipped, shut down any background processes and
 	// make sure they have returned the correct status.
 	for _, bg := range ts.background {
-		interruptProcess(bg.cmd.Process)
+		bg.group.interrupt()
 	}
 	ts.cmdWait(false, nil)
 
@@ -382,6 +731,195 @@ func (ts *TestScript) cmdSkip(neg bool, args []string) {
 	ts.t.Skip()
 }
 
+// stat checks file metadata.
+func (ts *TestScript) cmdStat(neg bool, args []string) {
+	type check struct {
+		flag string
+		// test reports why path with the given information does
+		// not satisfy the check, or returns nil if it does.
+		test func(path string, linfo fs.FileInfo) error
+	}
+	var checks []check
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flagName, value, ok := strings.Cut(args[0], "=")
+		if !ok || value == "" {
+			ts.Fatalf("invalid flag %q: want %s=value", args[0], flagName)
+		}
+		var test func(path string, linfo fs.FileInfo) error
+		switch flagName {
+		case "-type":
+			if value != "file" && value != "dir" && value != "symlink" {
+				ts.Fatalf("unknown file type %q: want file, dir or symlink", value)
+			}
+			test = func(path string, linfo fs.FileInfo) error {
+				if t := fileType(linfo); t != value {
+					return fmt.Errorf("is a %s, not a %s", t, value)
+				}
+				return nil
+			}
+		case "-target":
+			test = func(path string, linfo fs.FileInfo) error {
+				if linfo.Mode()&fs.ModeSymlink == 0 {
+					return fmt.Errorf("is a %s, not a symlink", fileType(linfo))
+				}
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				if target != value {
+					return fmt.Errorf("links to %s, not %s", target, value)
+				}
+				return nil
+			}
+		case "-perm":
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || perm&uint64(os.ModePerm) != perm {
+				ts.Fatalf("invalid mode: %s", value)
+			}
+			test = func(path string, linfo fs.FileInfo) error {
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				if got := info.Mode().Perm(); got != os.FileMode(perm) {
+					return fmt.Errorf("has permissions %#o, not %#o", got, perm)
+				}
+				return nil
+			}
+		case "-size", "-lines":
+			unit := "bytes"
+			if flagName == "-lines" {
+				unit = "lines"
+			}
+			cmp := ts.parseCount(flagName, value)
+			test = func(path string, linfo fs.FileInfo) error {
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				n := info.Size()
+				if unit == "lines" {
+					if info.IsDir() {
+						return fmt.Errorf("is a directory")
+					}
+					data, err := os.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					n = int64(countLines(data))
+				}
+				if !cmp(n) {
+					return fmt.Errorf("has %d %s, want %s", n, unit, value)
+				}
+				return nil
+			}
+		case "-newer", "-older":
+			other := ts.MkAbs(value)
+			test = func(path string, linfo fs.FileInfo) error {
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				otherInfo, err := os.Stat(other)
+				if err != nil {
+					return err
+				}
+				t, otherTime := info.ModTime(), otherInfo.ModTime()
+				if flagName == "-newer" && !t.After(otherTime) {
+					return fmt.Errorf("is not newer than %s", value)
+				}
+				if flagName == "-older" && !t.Before(otherTime) {
+					return fmt.Errorf("is not older than %s", value)
+				}
+				return nil
+			}
+		default:
+			ts.Fatalf("unknown flag %q", flagName)
+		}
+		checks = append(checks, check{args[0], test})
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		ts.Fatalf("usage: stat [-type=T] [-target=path] [-perm=mode] [-size=N] [-lines=N] [-newer=file] [-older=file] path...")
+	}
+	if neg && len(checks) == 0 {
+		ts.Fatalf("! stat requires at least one check; use '! exists' to check that files do not exist")
+	}
+	for _, arg := range args {
+		path := ts.MkAbs(arg)
+		linfo, err := os.Lstat(path)
+		if err != nil {
+			ts.Fatalf("%s does not exist", arg)
+		}
+		var failed error
+		for _, c := range checks {
+			if err := c.test(path, linfo); err != nil {
+				failed = fmt.Errorf("%s %v (%s)", arg, err, c.flag)
+				break
+			}
+		}
+		switch {
+		case failed != nil && !neg:
+			ts.Fatalf("%v", failed)
+		case failed == nil && neg:
+			var flags []string
+			for _, c := range checks {
+				flags = append(flags, c.flag)
+			}
+			ts.Fatalf("%s unexpectedly matches %s", arg, strings.Join(flags, " "))
+		}
+	}
+}
+
+// parseCount parses the value of a -size or -lines flag, returning
+// a function that reports whether a count satisfies it.
+func (ts *TestScript) parseCount(flagName, value string) func(int64) bool {
+	op := strings.TrimRight(value, "0123456789")
+	n, err := strconv.ParseInt(value[len(op):], 10, 64)
+	if err != nil {
+		ts.Fatalf("invalid %s=%s: want N, <N, <=N, >N or >=N", flagName, value)
+	}
+	switch op {
+	case "":
+		return func(m int64) bool { return m == n }
+	case "<":
+		return func(m int64) bool { return m < n }
+	case "<=":
+		return func(m int64) bool { return m <= n }
+	case ">":
+		return func(m int64) bool { return m > n }
+	case ">=":
+		return func(m int64) bool { return m >= n }
+	}
+	ts.Fatalf("invalid %s=%s: want N, <N, <=N, >N or >=N", flagName, value)
+	panic("unreachable")
+}
+
+// fileType returns the type of file described by info,
+// as used by the stat command.
+func fileType(info fs.FileInfo) string {
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "special file"
+	}
+}
+
+// countLines returns the number of lines in data. A final line
+// without a trailing newline is counted.
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
 func (ts *TestScript) cmdStdin(neg bool, args []string) {
 	if neg {
 		ts.Fatalf("unsupported: ! stdin")
@@ -493,10 +1031,6 @@ func (ts *TestScript) cmdUNIX2DOS(neg bool, args []string) {
 
 // cmdKill kills background commands.
 func (ts *TestScript) cmdKill(neg bool, args []string) {
-	signals := map[string]os.Signal{
-		"INT":  os.Interrupt,
-		"KILL": os.Kill,
-	}
 	var (
 		name   string
 		signal os.Signal
@@ -506,7 +1040,7 @@ func (ts *TestScript) cmdKill(neg bool, args []string) {
 	case 1, 2:
 		sig, ok := strings.CutPrefix(args[0], "-")
 		if ok {
-			signal, ok = signals[sig]
+			signal, ok = signals[strings.TrimPrefix(sig, "SIG")]
 			if !ok {
 				ts.Fatalf("unknown signal: %s", sig)
 			}
@@ -538,7 +1072,7 @@ func (ts *TestScript) killBackgroundOne(bgName string, signal os.Signal) {
 	if bg == nil {
 		ts.Fatalf("unknown background process %q", bgName)
 	}
-	err := bg.cmd.Process.Signal(signal)
+	err := bg.group.signal(signal)
 	if err != nil {
 		ts.Fatalf("unexpected error terminating background command %q: %v", bgName, err)
 	}
@@ -546,7 +1080,7 @@ func (ts *TestScript) killBackgroundOne(bgName string, signal os.Signal) {
 
 func (ts *TestScript) killBackground(signal os.Signal) {
 	for bgName, bg := range ts.background {
-		err := bg.cmd.Process.Signal(signal)
+		err := bg.group.signal(signal)
 		if err != nil {
 			ts.Fatalf("unexpected error terminating background command %q: %v", bgName, err)
 		}
@@ -555,20 +1089,65 @@ func (ts *TestScript) killBackground(signal os.Signal) {
 
 // cmdWait waits for background commands to exit, setting stderr and stdout to their result.
 func (ts *TestScript) cmdWait(neg bool, args []string) {
-	if len(args) > 1 {
-		ts.Fatalf("usage: wait [name]")
+	var want *exitWant
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if want != nil {
+			ts.Fatalf("wait: only one of -exit and -signal may be given")
+		}
+		if v, ok := strings.CutPrefix(args[0], "-exit="); ok {
+			code, err := strconv.Atoi(v)
+			if err != nil || code < 0 {
+				ts.Fatalf("wait: invalid exit status %q", v)
+			}
+			want = &exitWant{code: code}
+		} else if v, ok := strings.CutPrefix(args[0], "-signal="); ok {
+			v = strings.TrimPrefix(v, "SIG")
+			if _, ok := signals[v]; !ok {
+				ts.Fatalf("wait: unknown signal: %s", v)
+			}
+			want = &exitWant{signal: v}
+		} else {
+			ts.Fatalf("wait: unknown flag %s", args[0])
+		}
+		args = args[1:]
+	}
+	if len(args) > 1 || (want != nil && len(args) == 0) {
+		ts.Fatalf("usage: wait [-exit=N | -signal=SIGNAL] [name]")
 	}
 	if neg {
 		ts.Fatalf("unsupported: ! wait")
 	}
 	if len(args) > 0 {
-		ts.waitBackgroundOne(args[0])
+		ts.waitBackgroundOne(args[0], want)
 	} else {
 		ts.waitBackground(true)
 	}
 }
 
-func (ts *TestScript) waitBackgroundOne(bgName string) {
+// exitWant describes how a background command is expected to
+// terminate: either with the given exit status, or if signal is
+// non-empty, by the named signal.
+type exitWant struct {
+	code   int
+	signal string
+}
+
+// checkExit fails the script if state does not match want.
+func (ts *TestScript) checkExit(state *os.ProcessState, want *exitWant) {
+	got := exitSignal(state)
+	switch {
+	case want.signal != "" && got == "":
+		ts.Fatalf("command exited with status %d, want signal %s", state.ExitCode(), want.signal)
+	case want.signal != "" && got != want.signal:
+		ts.Fatalf("command terminated by signal %s, want signal %s", got, want.signal)
+	case want.signal == "" && got != "":
+		ts.Fatalf("command terminated by signal %s, want exit status %d", got, want.code)
+	case want.signal == "" && state.ExitCode() != want.code:
+		ts.Fatalf("command exited with status %d, want exit status %d", state.ExitCode(), want.code)
+	}
+}
+
+func (ts *TestScript) waitBackgroundOne(bgName string, want *exitWant) {
 	bg := ts.findBackground(bgName)
 	if bg == nil {
 		ts.Fatalf("unknown background process %q", bgName)
@@ -582,9 +1161,17 @@ func (ts *TestScript) waitBackgroundOne(bgName string) {
 	if ts.stderr != "" {
 		fmt.Fprintf(&ts.log, "[stderr]\n%s", ts.stderr)
 	}
+	if bg.usage {
+		ts.logUsage(bg.cmd.ProcessState)
+	}
 	// Note: ignore bg.neg, which only takes effect on the non-specific
 	// wait command.
-	if bg.cmd.ProcessState.Success() {
+	if want != nil {
+		if ts.ctxt.Err() != nil {
+			ts.Fatalf("test timed out while running command")
+		}
+		ts.checkExit(bg.cmd.ProcessState, want)
+	} else if bg.cmd.ProcessState.Success() {
 		if bg.neg {
 			ts.Fatalf("unexpected command success")
 		}
@@ -624,6 +1211,9 @@ func (ts *TestScript) waitBackground(checkStatus bool) {
 
 		args := append([]string{filepath.Base(bg.cmd.Args[0])}, bg.cmd.Args[1:]...)
 		fmt.Fprintf(&ts.log, "[background] %s: %v\n", strings.Join(args, " "), bg.cmd.ProcessState)
+		if bg.usage {
+			ts.logUsage(bg.cmd.ProcessState)
+		}
 
 		cmdStdout := bg.cmd.Stdout.(*strings.Builder).String()
 		if cmdStdout != "" {
@@ -660,34 +1250,46 @@ func (ts *TestScript) waitBackground(checkStatus bool) {
 
 // scriptMatch implements both stdout and stderr.
 func scriptMatch(ts *TestScript, neg bool, args []string, text, name string) {
-	n := 0
-	if len(args) >= 1 && strings.HasPrefix(args[0], "-count=") {
-		if neg {
-			ts.Fatalf("cannot use -count= with negated match")
-		}
-		var err error
-		n, err = strconv.Atoi(args[0][len("-count="):])
-		if err != nil {
-			ts.Fatalf("bad -count=: %v", err)
-		}
-		if n < 1 {
-			ts.Fatalf("bad -count=: must be at least 1")
-		}
-		args = args[1:]
-	}
-
 	extraUsage := ""
 	want := 1
 	if name == "grep" {
 		extraUsage = " file"
 		want = 2
 	}
+
+	n := 0
+	exact := false
+	for len(args) > want {
+		switch {
+		case strings.HasPrefix(args[0], "-count="):
+			if neg {
+				ts.Fatalf("cannot use -count= with negated match")
+			}
+			var err error
+			n, err = strconv.Atoi(args[0][len("-count="):])
+			if err != nil {
+				ts.Fatalf("bad -count=: %v", err)
+			}
+			if n < 1 {
+				ts.Fatalf("bad -count=: must be at least 1")
+			}
+		case args[0] == "-exact":
+			exact = true
+		default:
+			ts.Fatalf("usage: %s [-count=N] [-exact] 'pattern'%s", name, extraUsage)
+		}
+		args = args[1:]
+	}
 	if len(args) != want {
-		ts.Fatalf("usage: %s [-count=N] 'pattern'%s", name, extraUsage)
+		ts.Fatalf("usage: %s [-count=N] [-exact] 'pattern'%s", name, extraUsage)
 	}
 
 	pattern := args[0]
-	re, err := regexp.Compile(`(?m)` + pattern)
+	rePattern := pattern
+	if exact {
+		rePattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(`(?m)` + rePattern)
 	ts.Check(err)
 
 	isGrep := name == "grep"
@@ -710,6 +1312,9 @@ func scriptMatch(ts *TestScript, neg bool, args []string, text, name string) {
 			if isGrep {
 				ts.Logf("[%s]\n%s\n", name, text)
 			}
+			if ts.params.UpdateMatches && (name == "stdout" || name == "stderr") && ts.updateMatch(text, exact) {
+				return
+			}
 			ts.Fatalf("no match for %#q found in %s", pattern, name)
 		}
 		if n > 0 {
@@ -724,6 +1329,152 @@ func scriptMatch(ts *TestScript, neg bool, args []string, text, name string) {
 	}
 }
 
+// updateMatch rewrites the current stdout or stderr line in the
+// script so that its pattern is the line of text most similar to it,
+// as requested by Params.UpdateMatches. It reports whether it did so;
+// only patterns written as literal text can be rewritten, and lines
+// are not rewritten by retry attempts that will be run again. The
+// script file itself is written by applyScriptUpdates.
+func (ts *TestScript) updateMatch(text string, exact bool) bool {
+	if ts.tentative {
+		return false
+	}
+	lines := strings.Split(string(ts.archive.Comment), "\n")
+	if ts.lineno < 1 || ts.lineno > len(lines) {
+		return false
+	}
+	line := lines[ts.lineno-1]
+	if update, ok := ts.lineUpdates[ts.lineno]; ok {
+		line = update
+	}
+	spans := wordSpans(line)
+	if len(spans) == 0 {
+		return false
+	}
+	span := spans[len(spans)-1]
+	// The pattern must not depend on environment variables,
+	// and must match literally.
+	pattern := line[span[0]:span[1]]
+	if strings.Contains(pattern, "$") {
+		return false
+	}
+	pattern = unquoteArg(pattern)
+	if !exact && regexp.QuoteMeta(pattern) != pattern {
+		return false
+	}
+	actual, ok := closestLine(text, pattern)
+	if !ok {
+		return false
+	}
+	replacement := quoteArg(actual)
+	if !exact && regexp.QuoteMeta(actual) != actual {
+		replacement = "-exact " + replacement
+	}
+	line = line[:span[0]] + replacement + line[span[1]:]
+	ts.lineUpdates[ts.lineno] = line
+	return true
+}
+
+// closestLine returns the non-empty line of text with the smallest
+// edit distance from pattern. It reports false if there is no
+// suitable line.
+func closestLine(text, pattern string) (string, bool) {
+	best, bestDist := "", -1
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || line == "-exact" || strings.HasPrefix(line, "-count=") {
+			continue
+		}
+		if d := editDistance(line, pattern); bestDist < 0 || d < bestDist {
+			best, bestDist = line, d
+		}
+	}
+	return best, bestDist >= 0
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// wordSpans returns the start and end offsets of each argument
+// in a script line, splitting it in the same way as TestScript.parse.
+func wordSpans(line string) [][2]int {
+	var spans [][2]int
+	start := -1
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if !quoted && (c == ' ' || c == '\t' || c == '\r' || c == '#') {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+			if c == '#' {
+				return spans
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		if c == '\'' {
+			quoted = !quoted
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(line)})
+	}
+	return spans
+}
+
+// unquoteArg returns the value of a script argument
+// that contains no environment variable references.
+func unquoteArg(word string) string {
+	var buf strings.Builder
+	quoted := false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		if c != '\'' {
+			buf.WriteByte(c)
+			continue
+		}
+		if quoted && i+1 < len(word) && word[i+1] == '\'' {
+			// 'foo''bar' means foo'bar.
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		quoted = !quoted
+	}
+	return buf.String()
+}
+
+// quoteArg returns s quoted if necessary so that
+// TestScript.parse yields it as a single argument.
+func quoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r#'$") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
 // unix2DOS returns data with UNIX line endings converted to DOS line endings.
 func unix2DOS(data []byte) ([]byte, error) {
 	sb := &strings.Builder{}
@@ -0,0 +1,159 @@
+package testscript
+
+import (
+	"fmt"
+	"strings"
+)
+
+// condExpr holds a parsed condition expression, as found between the
+// square brackets of a [cond] command prefix. For example:
+//
+//	linux || darwin
+//	!short && exec:git
+//	(linux || darwin) && !net
+type condExpr struct {
+	op   string // "" for a plain condition, or one of "!", "&&", "||"
+	name string // the condition name when op is ""
+	x, y *condExpr
+}
+
+// parseCondExpr parses a condition expression. The ! operator binds
+// most tightly, followed by && and then ||, as in Go.
+func parseCondExpr(s string) (*condExpr, error) {
+	p := &condParser{toks: tokenizeCond(s)}
+	if len(p.toks) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return e, nil
+}
+
+type condParser struct {
+	toks []string
+}
+
+func (p *condParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return p.toks[0]
+}
+
+func (p *condParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.toks = p.toks[1:]
+	}
+	return tok
+}
+
+func (p *condParser) or() (*condExpr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &condExpr{op: "||", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *condParser) and() (*condExpr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = &condExpr{op: "&&", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *condParser) unary() (*condExpr, error) {
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "!":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{op: "!", x: x}, nil
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return x, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("unexpected %q", tok)
+	default:
+		return &condExpr{name: tok}, nil
+	}
+}
+
+// tokenizeCond splits a condition expression into operators,
+// parentheses and condition names. A lone & or | is returned
+// as a token of its own so that the parser can report it.
+func tokenizeCond(s string) []string {
+	var toks []string
+	for s != "" {
+		switch {
+		case s[0] == ' ' || s[0] == '\t':
+			s = s[1:]
+		case strings.HasPrefix(s, "&&"), strings.HasPrefix(s, "||"):
+			toks = append(toks, s[:2])
+			s = s[2:]
+		case strings.ContainsRune("!()&|", rune(s[0])):
+			toks = append(toks, s[:1])
+			s = s[1:]
+		default:
+			i := strings.IndexAny(s, " \t!()&|")
+			if i < 0 {
+				i = len(s)
+			}
+			toks = append(toks, s[:i])
+			s = s[i:]
+		}
+	}
+	return toks
+}
+
+// evalCond reports whether the condition expression e is satisfied.
+// The && and || operators do not evaluate their right hand operand
+// if the left hand operand determines the result.
+func (ts *TestScript) evalCond(e *condExpr) (bool, error) {
+	switch e.op {
+	case "":
+		return ts.condition(e.name)
+	case "!":
+		ok, err := ts.evalCond(e.x)
+		return !ok, err
+	case "&&", "||":
+		ok, err := ts.evalCond(e.x)
+		if err != nil || ok == (e.op == "||") {
+			return ok, err
+		}
+		return ts.evalCond(e.y)
+	}
+	panic("unreachable")
+}
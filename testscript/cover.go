@@ -0,0 +1,195 @@
+package testscript
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// coverageRun tracks the scripts run by RunT with Params.CoverDir set.
+type coverageRun struct {
+	dir    string
+	onLast bool // finish when the last script finishes, as T has no Cleanup method
+
+	mu    sync.Mutex
+	names []string // names of the scripts that have run
+}
+
+func (c *coverageRun) add(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+}
+
+// finish writes the coverage report for the scripts that have run,
+// logging any error to t.
+func (c *coverageRun) finish(t T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := finishCoverage(c.dir, c.names, os.Getenv("GOCOVERDIR")); err != nil {
+		t.Log(fmt.Sprintf("cannot write coverage report: %v", err))
+	}
+}
+
+// coverFunc holds a function listed by "go tool covdata func".
+type coverFunc struct {
+	pos  string // file and line, for example "example.com/foo/main.go:12"
+	name string
+}
+
+// scriptCoverDir returns the directory holding coverage data
+// for the named script when Params.CoverDir is set.
+func scriptCoverDir(coverDir, name string) string {
+	return filepath.Join(coverDir, "scripts", name)
+}
+
+// coveredFuncs runs "go tool covdata func" on the coverage data in dir,
+// returning all the functions it lists along with the subset of them
+// that were covered. A directory without coverage data covers nothing.
+func coveredFuncs(goBin, dir string) (all, covered []coverFunc, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		return nil, nil, err
+	}
+	cmd := exec.Command(goBin, "tool", "covdata", "func", "-i="+dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("go tool covdata func: %v\n%s", err, stderr.Bytes())
+	}
+	all, covered = parseCovdataFunc(out)
+	return all, covered, nil
+}
+
+// parseCovdataFunc parses the output of "go tool covdata func",
+// which has lines of the form
+//
+//	example.com/foo/main.go:12:	main		75.0%
+//
+// followed by a line giving the total.
+func parseCovdataFunc(out []byte) (all, covered []coverFunc) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] == "total" {
+			continue
+		}
+		f := coverFunc{
+			pos:  strings.TrimSuffix(fields[0], ":"),
+			name: fields[1],
+		}
+		all = append(all, f)
+		if fields[2] != "0.0%" {
+			covered = append(covered, f)
+		}
+	}
+	return all, covered
+}
+
+// writeCoverReport writes a report of the functions covered by each of
+// the named scripts, the scripts that cover no function that other
+// scripts do not, and the functions that no script covers. The order
+// of functions is taken from all.
+func writeCoverReport(w io.Writer, all []coverFunc, covered map[string][]coverFunc) error {
+	bw := bufio.NewWriter(w)
+	scripts := slices.Sorted(maps.Keys(covered))
+	coveredBy := make(map[coverFunc][]string)
+	for _, name := range scripts {
+		for _, f := range covered[name] {
+			coveredBy[f] = append(coveredBy[f], name)
+		}
+	}
+
+	fmt.Fprintf(bw, "Functions covered by each script:\n")
+	for _, name := range scripts {
+		fmt.Fprintf(bw, "\n%s\n", name)
+		for _, f := range covered[name] {
+			fmt.Fprintf(bw, "\t%s: %s\n", f.pos, f.name)
+		}
+	}
+
+	fmt.Fprintf(bw, "\nScripts covering no function that other scripts do not:\n")
+	for _, name := range scripts {
+		unique := slices.ContainsFunc(covered[name], func(f coverFunc) bool {
+			return len(coveredBy[f]) == 1
+		})
+		if !unique {
+			fmt.Fprintf(bw, "\t%s\n", name)
+		}
+	}
+
+	fmt.Fprintf(bw, "\nFunctions not covered by any script:\n")
+	for _, f := range all {
+		if len(coveredBy[f]) == 0 {
+			fmt.Fprintf(bw, "\t%s: %s\n", f.pos, f.name)
+		}
+	}
+	return bw.Flush()
+}
+
+// finishCoverage writes the coverage report for the scripts run with
+// Params.CoverDir set, and copies their coverage data to dstDir, if
+// it is not empty, so that it is also included in the coverage for
+// the test as a whole.
+func finishCoverage(coverDir string, names []string, dstDir string) error {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		return err
+	}
+	var all []coverFunc
+	seen := make(map[coverFunc]bool)
+	covered := make(map[string][]coverFunc)
+	for _, name := range names {
+		dir := scriptCoverDir(coverDir, name)
+		funcs, scriptCovered, err := coveredFuncs(goBin, dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range funcs {
+			if !seen[f] {
+				seen[f] = true
+				all = append(all, f)
+			}
+		}
+		covered[name] = scriptCovered
+		if dstDir != "" {
+			if err := copyCoverData(dir, dstDir); err != nil {
+				return err
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeCoverReport(&buf, all, covered); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(coverDir, "report.txt"), buf.Bytes(), 0o666)
+}
+
+// copyCoverData copies the coverage data files in src to dst.
+// Meta-data files are named after their contents,
+// so any that already exist in dst are left alone.
+func copyCoverData(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		to := filepath.Join(dst, entry.Name())
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, entry.Name()), to, 0o666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -34,6 +34,12 @@ free to mutate global variables without polluting the top level test binary.
 		})
 	}
 
+Starting a copy of the test binary for every command can be slow. Commands
+that take their arguments, standard input and output, environment and
+working directory from a Proc, and return an exit code rather than calling
+os.Exit, can be registered with MainWithProcs instead. When a script runs
+such a command in the foreground, it is called within the test process.
+
 In general script files should have short names: a few words, not whole sentences.
 The first word should be the general category of behavior being tested,
 often the name of a subcommand to be tested or a concept (vendor, pattern).
@@ -59,6 +65,7 @@ Scripts also have access to these other environment variables:
 	PATH=<actual PATH>
 	HOME=/no-home (USERPROFILE on windows, home on plan9)
 	TMPDIR=$WORK/.tmp (TMP on windows)
+	SCRIPTDIR=<absolute path of the directory containing the script>
 	devnull=<value of os.DevNull>
 	/=<value of os.PathSeparator>
 	:=<value of os.PathListSeparator>
@@ -67,6 +74,22 @@ Scripts also have access to these other environment variables:
 The environment variable $exe (lowercase) is an empty string on most
 systems, ".exe" on Windows.
 
+If Params.IsolatedHome is set, HOME instead refers to a writable directory,
+$WORK/.home, and XDG_CONFIG_HOME, XDG_CACHE_HOME and XDG_DATA_HOME refer to
+$WORK/.home/.config, $WORK/.home/.cache and $WORK/.home/.local/share
+respectively. On Windows, APPDATA and LOCALAPPDATA are set too. The home
+directory can be populated with archive files whose names begin with ".home/":
+
+	exec mytool
+	cmp $XDG_CONFIG_HOME/mytool/state want-state
+
+	-- .home/.config/mytool/config --
+	verbose = true
+
+If Params.Template is set, the directory tree it describes is built once
+and copied into $WORK before anything else, using copy-on-write clones
+where the file system supports them.
+
 The script's supporting files are unpacked relative to $WORK
 and then the script begins execution in that
 directory as well. Thus the example above runs in $WORK
@@ -120,7 +143,16 @@ the condition [darwin] is true if GOOS=darwin, and [amd64] is true if GOARCH=amd
 A condition can be negated: [!short] means to run the rest of the line
 when testing.Short() is false.
 
-Additional conditions can be added by passing a function to Params.Condition.
+Conditions can be combined with the && and || operators and grouped
+with parentheses, with the same precedence as in Go. For example,
+[linux || darwin] runs the rest of the line on either Linux or macOS,
+and [!short && (exec:git || exec:hg)] requires both that testing.Short()
+is false and that one of git or hg is available. The right hand side of
+&& and || is only evaluated when needed. Multiple condition prefixes,
+as in [linux] [!short], must all be satisfied.
+
+Additional conditions can be added by passing a function to Params.Condition,
+or documented conditions by adding entries to Params.Conditions.
 
 The predefined commands are:
 
@@ -148,15 +180,44 @@ The predefined commands are:
     src can include "stdout" or "stderr" to use the standard output or standard error
     from the most recent exec or go command.
 
+  - defer command [args...]
+    Queue the given command to run when the script ends, whether or not the
+    script has failed. Deferred commands run in the reverse order to which
+    they were queued, after any background commands have finished, and their
+    output is appended to the log. The command may be negated, as in
+    'defer ! exec prog'. Its arguments are expanded when defer runs, and a
+    failure of the deferred command fails the test.
+
   - env [key=value...]
     With no arguments, print the environment (useful for debugging).
     Otherwise add the listed key=value pairs to the environment.
 
-  - [!] exec program [args...] [&]
+  - env -unset name...
+    Remove the named variables from the environment.
+
+  - [!] exec [-env=key=value...] [-rlimit=limits] program [args...] [&]
     Run the given executable program with the arguments.
     It must (or must not) succeed.
     Note that 'exec' does not terminate the script (unlike in Unix shells).
 
+    Each -env flag adds the given key=value pair to the environment of this
+    program only; the environment of later commands is unaffected.
+    User-supplied commands can do the same with TestScript.WithEnv.
+
+    On Linux, the -rlimit flag limits the resources available to the program
+    and its children. Its value is a comma-separated list of name=value pairs:
+    as for the address space in bytes (with an optional K, M or G suffix), cpu
+    for the CPU time in seconds (or a duration, rounded up to whole seconds),
+    and nofile for the number of open files. For example:
+
+    exec -rlimit=as=512M,cpu=10s prog
+
+    The limits are in place before the program starts running: the test binary
+    is run in its place, sets the limits on itself and then executes the
+    program. The program's CPU time and peak memory use are logged when it
+    exits, or for a background program when it is waited for, and so are also
+    part of any structured output made from the log.
+
     If the last token is '&', the program executes in the background. The standard
     output and standard error of the previous command is cleared, but the output
     of the background process is buffered — and checking of its exit status is
@@ -172,18 +233,31 @@ The predefined commands are:
     Standard input can be provided using the stdin command; this will be
     cleared after exec has been called.
 
+    On Unix-like systems, each program runs in its own process group, and
+    signals sent to it by 'kill' or at the end of the test are sent to the
+    whole group, so that any processes it starts are terminated too. Any
+    processes still running in the group at the end of the test are killed;
+    set Params.FailOnLeakedProcesses to make this fail the test.
+
   - [!] exists [-readonly] file...
     Each of the listed files or directories must (or must not) exist.
     If -readonly is given, the files or directories must be unwritable.
 
-  - [!] grep [-count=N] pattern file
+  - [!] grep [-count=N] [-exact] pattern file
     The file's content must (or must not) match the regular expression pattern.
     For positive matches, -count=N specifies an exact number of matches to require.
+    With -exact, the pattern is matched as literal text rather than as a
+    regular expression.
 
   - kill [-SIGNAL] [command]
     Terminate all 'exec' and 'go' commands started in the background (with the '&'
-    token) by sending an termination signal. Recognized signals are KILL and INT.
-    If no signal is specified, KILL is sent.
+    token) by sending an termination signal. On Unix systems any named signal,
+    such as TERM, HUP or USR1, may be given, with or without the SIG prefix;
+    elsewhere the recognized signals are KILL and INT. If no signal is
+    specified, KILL is sent.
+
+    The kill command does not wait for the commands to exit, so a command may be
+    sent a signal that it handles without terminating, and be waited for later.
 
     If a command argument is specified, it terminates only that command, which
     must have been started with the final token '&command&` as described for the
@@ -202,7 +276,16 @@ The predefined commands are:
   - skip [message]
     Mark the test skipped, including the message if given.
 
-  - [!] stderr [-count=N] pattern
+  - [!] stat [-type=T] [-target=path] [-perm=mode] [-size=N] [-lines=N] [-newer=file] [-older=file] path...
+    Check the metadata of each of the listed files or directories, which must exist.
+    The -type flag requires the type to be file, dir or symlink, and -target requires
+    a symlink to the given target. The -perm flag requires the given octal permission
+    bits, such as 0755. The -size and -lines flags require the given size in bytes or
+    number of lines, and also accept a comparison such as <N, <=N, >N or >=N.
+    The -newer and -older flags compare the modification time with that of another file.
+    With the ! prefix, at least one of the checks must fail for each path.
+
+  - [!] stderr [-count=N] [-exact] pattern
     Apply the grep command (see above) to the standard error
     from the most recent exec or wait command.
 
@@ -211,9 +294,11 @@ The predefined commands are:
     File can be "stdout" or "stderr" to use the standard output or standard error
     from the most recent exec or wait command.
 
-  - [!] stdout [-count=N] pattern
+  - [!] stdout [-count=N] [-exact] pattern
     Apply the grep command (see above) to the standard output
     from the most recent exec or wait command.
+    If Params.UpdateMatches is set, failing stdout and stderr commands with
+    literal patterns are rewritten to match the actual output.
 
   - ttyin [-stdin] file
     Attach the next exec command to a controlling pseudo-terminal, and use the
@@ -221,7 +306,7 @@ The predefined commands are:
     also attach the terminal to standard input.
     Note that this does not attach the terminal to standard output/error.
 
-  - [!] ttyout [-count=N] pattern
+  - [!] ttyout [-count=N] [-exact] pattern
     Apply the grep command (see above) to the raw controlling terminal output
     from the most recent exec command.
 
@@ -237,7 +322,7 @@ The predefined commands are:
     txtar file markers.
     See also https://godoc.org/github.com/rogpeppe/go-internal/txtar#Unquote
 
-  - wait [command]
+  - wait [-exit=N | -signal=SIGNAL] [command]
     Wait for all 'exec' and 'go' commands started in the background (with the '&'
     token) to exit, and display success or failure status for them.
     After a call to wait, the 'stderr' and 'stdout' commands will apply to the
@@ -246,7 +331,41 @@ The predefined commands are:
 
     If an argument is specified, it waits for just that command, which
     must have been started with the final token '&command&` as described for the
-    exec command.
+    exec command. With -exit=N, the command must have exited with status N; with
+    -signal=SIGNAL, it must have been terminated by the named signal. Either flag
+    overrides any '!' or '?' prefix given when the command was started.
+
+Lines can be grouped into blocks, which end with a line containing only
+"end". The lines inside a block are conventionally indented. Blocks can
+be nested, and the words if, else, retry and end are reserved for them.
+
+An if block runs the lines it contains only when its condition, which is
+written as for a [cond] prefix, is satisfied. An optional else line
+starts lines to run when the condition is not satisfied:
+
+	if [linux || darwin]
+		exec uname
+		stdout .
+	else
+		skip 'needs uname'
+	end
+
+A retry block runs the lines it contains up to the given number of
+attempts, waiting for the given interval between attempts, until they
+all succeed. Only a failure in the final attempt fails the test, which
+is useful for checking the effects of background commands:
+
+	exec server &
+	retry 10 100ms
+		exists server.ready
+	end
+
+Additional commands can be added with Params.Cmds or Params.Commands.
+Commands in Params.Commands carry documentation, including an argument
+synopsis which is used to check the number of arguments and whether the
+! prefix is supported before the command is run. Params.WriteReference
+writes documentation for all the commands and conditions available to
+a script.
 
 When TestScript runs a script and the script fails, by default TestScript shows
 the execution of the most recent phase of the script (since the last # comment)
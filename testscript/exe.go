@@ -5,12 +5,20 @@
 package testscript
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/rogpeppe/go-internal/internal/os/execpath"
 )
 
 // TestingM is implemented by *testing.M. It's defined as an interface
@@ -38,6 +46,48 @@ func IgnoreMissedCoverage() {}
 // This can be disabled with Params.RequireExplicitExec to keep consistency
 // across test scripts, and to keep separate process executions explicit.
 func Main(m TestingM, commands map[string]func()) {
+	MainWithProcs(m, commands, nil)
+}
+
+// Proc holds the arguments, standard input and output, environment
+// and working directory of a command registered with [MainWithProcs].
+type Proc struct {
+	// Context is done when the command should stop, for example
+	// because the script has timed out. A command running within
+	// the test process cannot be killed, so it should return
+	// promptly once Context is done; if it does not return within
+	// the script's grace period, the script fails and the command
+	// is abandoned.
+	Context context.Context
+	// Args holds the command line arguments,
+	// starting with the command name.
+	Args   []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env holds the environment, in the form "key=value".
+	Env []string
+	// Dir holds the working directory.
+	Dir string
+}
+
+// MainWithProcs is like [Main], but also accepts commands written against
+// [Proc], which return an exit code instead of calling [os.Exit].
+//
+// When a script runs one of these commands in the foreground, with
+// "exec" or directly by name, it runs within the test process, avoiding
+// the cost of starting a copy of the test binary. In all other cases,
+// such as when run in the background, with "exec -rlimit", with "ttyin",
+// by another program, or when the script has changed $PATH so that the
+// name finds a different program, it runs as a subprocess like the
+// commands registered with [Main].
+//
+// A command running within the test process must only use the
+// arguments, files, environment and directory provided by its Proc,
+// must not call os.Exit, and must be safe to call concurrently, as
+// scripts run in parallel. Commands that rely on global state should
+// be registered as subprocess commands in the commands map instead.
+func MainWithProcs(m TestingM, commands map[string]func(), procs map[string]func(p *Proc) int) {
 	// Depending on os.Args[0], this is either the top-level execution of
 	// the test binary by "go test", or the execution of one of the provided
 	// commands via "foo" or "exec foo".
@@ -46,11 +96,28 @@ func Main(m TestingM, commands map[string]func()) {
 	if runtime.GOOS == "windows" {
 		cmdName = strings.TrimSuffix(cmdName, ".exe")
 	}
+	if procf := procs[cmdName]; procf != nil {
+		// A command written against Proc is being run as a subprocess.
+		os.Args[0] = cmdName
+		dir, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(procf(&Proc{
+			Context: context.Background(),
+			Args:    os.Args,
+			Stdin:   os.Stdin,
+			Stdout:  os.Stdout,
+			Stderr:  os.Stderr,
+			Env:     os.Environ(),
+			Dir:     dir,
+		}))
+	}
 	mainf := commands[cmdName]
 	if mainf == nil {
 		// Unknown command; this is just the top-level execution of the
 		// test binary by "go test".
-		os.Exit(testingMRun(m, commands))
+		os.Exit(testingMRun(m, commands, procs))
 	}
 	// The command being registered is being invoked, so run it, then exit.
 	os.Args[0] = cmdName
@@ -58,8 +125,16 @@ func Main(m TestingM, commands map[string]func()) {
 	os.Exit(0)
 }
 
+// inProcessCmds holds the commands registered with MainWithProcs
+// that can run within the test process.
+var inProcessCmds = map[string]func(p *Proc) int{}
+
+// mainBinDir holds the directory in $PATH holding the commands
+// registered with Main and MainWithProcs.
+var mainBinDir string
+
 // testingMRun exists just so that we can use `defer`, given that [Main] above uses [os.Exit].
-func testingMRun(m TestingM, commands map[string]func()) int {
+func testingMRun(m TestingM, commands map[string]func(), procs map[string]func(p *Proc) int) int {
 	// Set up all commands in a directory, added in $PATH.
 	tmpdir, err := os.MkdirTemp("", "testscript-main")
 	if err != nil {
@@ -75,9 +150,21 @@ func testingMRun(m TestingM, commands map[string]func()) int {
 		log.Fatalf("could not set up PATH binary directory: %v", err)
 	}
 	os.Setenv("PATH", bindir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	mainBinDir = bindir
 
 	// We're not in a subcommand.
+	names := make([]string, 0, len(commands)+len(procs))
 	for name := range commands {
+		names = append(names, name)
+	}
+	for name, procf := range procs {
+		if commands[name] != nil {
+			log.Fatalf("command %q registered both as a subprocess and as an in-process command", name)
+		}
+		names = append(names, name)
+		inProcessCmds[name] = procf
+	}
+	for _, name := range names {
 		// Set up this command in the directory we added to $PATH.
 		binfile := filepath.Join(bindir, name)
 		if runtime.GOOS == "windows" {
@@ -90,16 +177,139 @@ func testingMRun(m TestingM, commands map[string]func()) int {
 		if err != nil {
 			log.Fatalf("could not set up %s in $PATH: %v", name, err)
 		}
-		scriptCmds[name] = func(ts *TestScript, neg bool, args []string) {
-			if ts.params.RequireExplicitExec {
-				ts.Fatalf("use 'exec %s' rather than '%s' (because RequireExplicitExec is enabled)", name, name)
-			}
-			ts.cmdExec(neg, append([]string{name}, args...))
+		scriptCmds[name] = Cmd{
+			Run: func(ts *TestScript, neg bool, args []string) {
+				if ts.params.RequireExplicitExec {
+					ts.Fatalf("use 'exec %s' rather than '%s' (because RequireExplicitExec is enabled)", name, name)
+				}
+				ts.cmdExec(neg, append([]string{name}, args...))
+			},
+			Args:      "[args...] [&]",
+			Summary:   "Run the " + name + " command registered with testscript.Main; equivalent to 'exec " + name + "'.",
+			Negatable: true,
 		}
 	}
 	return m.Run()
 }
 
+// exitError is returned by execInProcess when a
+// command exits with a non-zero status.
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// inProcessCmd returns the in-process command that would be run
+// by exec for the given command, if any. A registered command is
+// only run in-process when the script would otherwise run its copy
+// in the test binary's bin directory, and not, for example, when the
+// script has changed $PATH so that another program is found instead.
+func (ts *TestScript) inProcessCmd(command string) func(p *Proc) int {
+	procf := inProcessCmds[command]
+	if procf == nil || ts.ttyin != "" || len(ts.rlimits) > 0 {
+		return nil
+	}
+	path, err := execpath.Look(command, ts.Getenv)
+	if err != nil {
+		return nil
+	}
+	want := filepath.Join(mainBinDir, command)
+	if runtime.GOOS == "windows" {
+		want += ".exe"
+	}
+	if !strings.EqualFold(path, want) {
+		return nil
+	}
+	return procf
+}
+
+// execInProcess runs a command registered with MainWithProcs within
+// the test process, in the same way that exec runs a subprocess.
+// When the script's context is done, the command is given the
+// script's grace period to return before it is abandoned.
+func (ts *TestScript) execInProcess(procf func(p *Proc) int, command string, args []string) (stdout, stderr string, err error) {
+	stdoutBuf, stderrBuf := new(procOutput), new(procOutput)
+	p := &Proc{
+		Context: ts.ctxt,
+		Args:    append([]string{command}, args...),
+		Stdin:   strings.NewReader(ts.stdin),
+		Stdout:  stdoutBuf,
+		Stderr:  stderrBuf,
+		Env:     append(slices.Clip(ts.env), "PWD="+ts.cd),
+		Dir:     ts.cd,
+	}
+	ts.stdin = ""
+	done := make(chan int, 1)
+	go func() {
+		done <- runProc(procf, p)
+	}()
+	var code int
+	select {
+	case code = <-done:
+	case <-ts.ctxt.Done():
+		timer := time.NewTimer(ts.gracePeriod)
+		defer timer.Stop()
+		select {
+		case <-done:
+			// Report why the command stopped, as for subprocesses.
+			return stdoutBuf.String(), stderrBuf.String(), ts.ctxt.Err()
+		case <-timer.C:
+			// The command cannot be stopped, so leave it running
+			// and stop recording its output.
+			stdoutBuf.close()
+			stderrBuf.close()
+			err = fmt.Errorf("in-process command %s did not return after %v: %w", command, ts.gracePeriod, ts.ctxt.Err())
+			return stdoutBuf.String(), stderrBuf.String(), err
+		}
+	}
+	if code != 0 {
+		err = exitError(code)
+	}
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
+
+// procOutput records the output of an in-process command.
+// Once it is closed, further writes fail.
+type procOutput struct {
+	mu     sync.Mutex
+	buf    strings.Builder
+	closed bool
+}
+
+func (o *procOutput) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, os.ErrClosed
+	}
+	return o.buf.Write(data)
+}
+
+func (o *procOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+}
+
+func (o *procOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// runProc calls procf, treating a panic as a failure
+// in the same way as the Go runtime.
+func runProc(procf func(p *Proc) int, p *Proc) (code int) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Fprintf(p.Stderr, "panic: %v\n\n%s", e, debug.Stack())
+			code = 2
+		}
+	}()
+	return procf(p)
+}
+
 // Deprecated: use [Main], as the only reason for returning exit codes
 // was to collect full code coverage, which Go does automatically now:
 // https://go.dev/blog/integration-test-coverage
@@ -127,11 +337,11 @@ func RunMain(m TestingM, commands map[string]func() int) (exitCode int) {
 // Second, symlinks might not be available on some environments, so we have to
 // implement a "full copy" fallback anyway.
 //
-// However, we do try to use cloneFile, since that will probably work on most
-// unix-like setups. Note that "go test" also places test binaries in the
-// system's temporary directory, like we do.
+// However, we do try to use cloneFile, allowing hard links, since that will
+// probably work on most unix-like setups. Note that "go test" also places test
+// binaries in the system's temporary directory, like we do.
 func copyBinary(from, to string) error {
-	if err := cloneFile(from, to); err == nil {
+	if err := cloneFile(from, to, 0o777, true); err == nil {
 		return nil
 	}
 	writer, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE, 0o777)
@@ -0,0 +1,51 @@
+package testscript
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// installExecutables copies each program in Params.Executables into a
+// new bin directory inside dir, returning the directory, and adds a
+// command to p.Commands for each one that does not already have one.
+func installExecutables(p *Params, dir string) (string, error) {
+	binDir, err := os.MkdirTemp(dir, "bin")
+	if err != nil {
+		return "", err
+	}
+	p.Commands = maps.Clone(p.Commands)
+	if p.Commands == nil {
+		p.Commands = make(map[string]Cmd)
+	}
+	for name, path := range p.Executables {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid executable name %q", name)
+		}
+		binfile := filepath.Join(binDir, name)
+		if runtime.GOOS == "windows" && !strings.HasSuffix(name, ".exe") {
+			binfile += ".exe"
+		}
+		if err := copyBinary(path, binfile); err != nil {
+			return "", fmt.Errorf("cannot install %s: %v", name, err)
+		}
+		if _, ok := p.Commands[name]; ok {
+			continue
+		}
+		p.Commands[name] = Cmd{
+			Run: func(ts *TestScript, neg bool, args []string) {
+				if ts.params.RequireExplicitExec {
+					ts.Fatalf("use 'exec %s' rather than '%s' (because RequireExplicitExec is enabled)", name, name)
+				}
+				ts.cmdExec(neg, append([]string{name}, args...))
+			},
+			Args:      "[args...] [&]",
+			Summary:   "Run " + path + "; equivalent to 'exec " + name + "'.",
+			Negatable: true,
+		}
+	}
+	return binDir, nil
+}
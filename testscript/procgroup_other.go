@@ -0,0 +1,24 @@
+//go:build !unix
+
+package testscript
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalGroup(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+func killGroup(pgid int) {}
+
+func groupProcesses(pgid int) []string {
+	return nil
+}
+
+func groupRunning(pgid int) bool {
+	return false
+}
@@ -0,0 +1,94 @@
+//go:build unix
+
+package testscript
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup arranges for cmd to run in a new process group,
+// so that any processes it starts can be signalled along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// A new session also creates a new process group,
+	// and a session leader cannot change its process group.
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+}
+
+// signalGroup sends sig to the process group led by p. Like
+// os.Process.Signal, it returns os.ErrProcessDone if p itself
+// has already been waited for.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return p.Signal(sig)
+	}
+	// Check before signalling the group, as the process may
+	// legitimately exit and be waited for as a result of the signal.
+	if err := p.Signal(syscall.Signal(0)); err != nil {
+		return err
+	}
+	if err := syscall.Kill(-p.Pid, s); err != nil {
+		return p.Signal(sig)
+	}
+	return nil
+}
+
+// killGroup kills any processes remaining in the process group pgid.
+func killGroup(pgid int) {
+	syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// groupProcesses returns a description of each process still running
+// in the process group pgid. Where /proc is available, processes that
+// have exited but not yet been reaped are ignored.
+func groupProcesses(pgid int) []string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		if syscall.Kill(-pgid, 0) == nil {
+			return []string{fmt.Sprintf("process group %d", pgid)}
+		}
+		return nil
+	}
+	var procs []string
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The stat file holds "pid (comm) state ppid pgrp ...",
+		// where comm may itself contain spaces and parentheses.
+		i, j := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+		if i < 0 || j < i {
+			continue
+		}
+		fields := bytes.Fields(data[j+1:])
+		if len(fields) < 3 || string(fields[0]) == "Z" {
+			continue
+		}
+		if string(fields[2]) != strconv.Itoa(pgid) {
+			continue
+		}
+		procs = append(procs, fmt.Sprintf("%s %s", entry.Name(), data[i:j+1]))
+	}
+	return procs
+}
+
+// groupRunning reports whether any process remains in the process
+// group pgid.
+func groupRunning(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
@@ -0,0 +1,228 @@
+package testscript
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Cmd describes a script command along with the documentation
+// needed to check its usage and to describe it to users.
+type Cmd struct {
+	// Run implements the command. It is called in the same way
+	// as the functions in Params.Cmds.
+	Run func(ts *TestScript, neg bool, args []string)
+
+	// Args holds the synopsis of the command's arguments, not
+	// including the command name or any ! prefix; for example
+	// "[-count=N] [-exact] pattern file". Square brackets mark optional
+	// arguments and a "..." suffix marks an argument that may be
+	// repeated. The synopsis is used to check the number of
+	// arguments before Run is called; if it is empty, the
+	// arguments are not checked.
+	Args string
+
+	// Summary holds a one-line description of the command.
+	Summary string
+
+	// Detail optionally holds further description of the command.
+	Detail string
+
+	// Flags describes the flags accepted by the command.
+	Flags []CmdFlag
+
+	// Negatable specifies whether the command supports the ! prefix.
+	// If it is false, a negated use of the command fails without
+	// calling Run.
+	Negatable bool
+}
+
+// CmdFlag describes a flag accepted by a script command.
+type CmdFlag struct {
+	// Name holds the flag as it is written in a script,
+	// for example "-count=N".
+	Name string
+	// Usage holds a short description of the flag.
+	Usage string
+}
+
+// Cond describes a script condition along with its documentation.
+type Cond struct {
+	// Eval reports whether the condition is satisfied. For a
+	// condition whose name ends in a colon, such as "exec:",
+	// suffix holds the text following the colon; otherwise
+	// it is empty.
+	Eval func(ts *TestScript, suffix string) (bool, error)
+
+	// Args names the text following the colon of a condition
+	// whose name ends in a colon, for example "prog".
+	Args string
+
+	// Summary holds a one-line description of the condition.
+	Summary string
+}
+
+// scriptConds documents the built-in conditions, which are
+// evaluated by TestScript.builtinCond.
+//
+// NOTE: If you make changes here, update doc.go.
+var scriptConds = map[string]Cond{
+	"short":   {Summary: "testing.Short() is true"},
+	"net":     {Summary: "the external network can be used"},
+	"link":    {Summary: "the OS has hard link support"},
+	"symlink": {Summary: "the OS has symbolic link support"},
+	"exec:":   {Args: "prog", Summary: "prog is available for execution (found by exec.LookPath)"},
+	"gc":      {Summary: "Go was built with gc"},
+	"gccgo":   {Summary: "Go was built with gccgo"},
+	"go1.x":   {Summary: "the Go version is 1.x or later"},
+	"unix":    {Summary: "the OS is Unix-like (would match the 'unix' build constraint)"},
+	"GOOS":    {Summary: "GOOS matches the given known operating system, for example [linux]"},
+	"GOARCH":  {Summary: "GOARCH matches the given known architecture, for example [amd64]"},
+}
+
+// AllCmds returns all the commands available to scripts run with p,
+// keyed by name: the built-in commands, any commands registered
+// with [Main], p.Commands, and p.Cmds. The commands from p.Cmds
+// carry no documentation, and are negatable.
+func (p *Params) AllCmds() map[string]Cmd {
+	cmds := make(map[string]Cmd)
+	for name, run := range p.Cmds {
+		cmds[name] = undocumentedCmd(run)
+	}
+	maps.Copy(cmds, p.Commands)
+	maps.Copy(cmds, scriptCmds)
+	return cmds
+}
+
+// undocumentedCmd returns the Cmd for a command in Params.Cmds.
+// Such commands are responsible for checking their own usage,
+// including the ! prefix, so they are treated as negatable.
+func undocumentedCmd(run func(ts *TestScript, neg bool, args []string)) Cmd {
+	return Cmd{Run: run, Negatable: true}
+}
+
+// AllConds returns documentation for all the conditions available to
+// scripts run with p, keyed by name: the built-in conditions and
+// p.Conditions. The Eval field is nil for the built-in conditions.
+// Conditions provided by p.Condition cannot be listed.
+func (p *Params) AllConds() map[string]Cond {
+	conds := maps.Clone(p.Conditions)
+	if conds == nil {
+		conds = make(map[string]Cond)
+	}
+	maps.Copy(conds, scriptConds)
+	return conds
+}
+
+// WriteReference writes reference documentation for all the commands
+// and conditions available to scripts run with p.
+func (p *Params) WriteReference(w io.Writer) error {
+	var buf strings.Builder
+	buf.WriteString("Commands:\n")
+	cmds := p.AllCmds()
+	for _, name := range slices.Sorted(maps.Keys(cmds)) {
+		buf.WriteString("\n")
+		buf.WriteString(cmds[name].Doc(name))
+	}
+	buf.WriteString("\nConditions:\n")
+	conds := p.AllConds()
+	for _, name := range slices.Sorted(maps.Keys(conds)) {
+		buf.WriteString("\n")
+		buf.WriteString(conds[name].Doc(name))
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// Synopsis returns the usage line for the command with the given name,
+// for example "[!] grep [-count=N] [-exact] pattern file".
+func (c Cmd) Synopsis(name string) string {
+	s := name
+	if c.Negatable {
+		s = "[!] " + s
+	}
+	if c.Args != "" {
+		s += " " + c.Args
+	}
+	return s
+}
+
+// Doc returns the reference documentation for the command with
+// the given name.
+func (c Cmd) Doc(name string) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s\n", c.Synopsis(name))
+	if c.Summary != "" {
+		fmt.Fprintf(&buf, "\t%s\n", c.Summary)
+	}
+	if c.Detail != "" {
+		for _, line := range strings.Split(strings.TrimSpace(c.Detail), "\n") {
+			fmt.Fprintf(&buf, "\t%s\n", line)
+		}
+	}
+	for _, f := range c.Flags {
+		fmt.Fprintf(&buf, "\t%s\n\t\t%s\n", f.Name, f.Usage)
+	}
+	return buf.String()
+}
+
+// Doc returns the reference documentation for the condition with
+// the given name.
+func (c Cond) Doc(name string) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "[%s%s]\n", name, c.Args)
+	if c.Summary != "" {
+		fmt.Fprintf(&buf, "\t%s\n", c.Summary)
+	}
+	return buf.String()
+}
+
+// checkUsage checks that the arguments to the command with
+// the given name are consistent with its documentation.
+func (ts *TestScript) checkUsage(name string, c Cmd, neg bool, args []string) {
+	if neg && !c.Negatable {
+		ts.Fatalf("unsupported: ! %s", name)
+	}
+	if c.Args == "" {
+		return
+	}
+	min, max := argCounts(c.Args)
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		ts.Fatalf("usage: %s %s", name, c.Args)
+	}
+}
+
+// argCounts returns the minimum and maximum number of arguments
+// allowed by the given argument synopsis. A negative maximum means
+// that there is no limit.
+func argCounts(synopsis string) (min, max int) {
+	depth := 0
+	optional := false
+	for _, word := range strings.Fields(synopsis) {
+		if depth == 0 {
+			optional = strings.HasPrefix(word, "[")
+		}
+		depth += strings.Count(word, "[") - strings.Count(word, "]")
+		if depth > 0 {
+			// The word is part of a larger bracketed group;
+			// only count the group once it ends.
+			continue
+		}
+		repeated := strings.HasSuffix(strings.TrimRight(word, "]"), "...")
+		switch {
+		case !optional:
+			min++
+			if max >= 0 {
+				max++
+			}
+		case max >= 0:
+			max++
+		}
+		if repeated {
+			max = -1
+		}
+	}
+	return min, max
+}
@@ -0,0 +1,108 @@
+package testscript
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rlimit holds a resource limit set by exec -rlimit.
+type rlimit struct {
+	name  string // as, cpu or nofile
+	value uint64 // in bytes, seconds or files respectively
+}
+
+// parseRlimits parses the value of an exec -rlimit flag, a
+// comma-separated list of name=value pairs such as "as=512M,cpu=10s".
+func parseRlimits(s string) ([]rlimit, error) {
+	var limits []rlimit
+	for _, item := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid limit %q: want name=value", item)
+		}
+		var n uint64
+		var err error
+		switch name {
+		case "as":
+			n, err = parseByteSize(value)
+		case "cpu":
+			n, err = parseCPUTime(value)
+		case "nofile":
+			n, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown limit %q: want as, cpu or nofile", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s limit %q", name, value)
+		}
+		limits = append(limits, rlimit{name, n})
+	}
+	return limits, nil
+}
+
+// formatRlimits formats limits in the form accepted by parseRlimits.
+func formatRlimits(limits []rlimit) string {
+	items := make([]string, len(limits))
+	for i, l := range limits {
+		items[i] = fmt.Sprintf("%s=%d", l.name, l.value)
+	}
+	return strings.Join(items, ",")
+}
+
+// parseByteSize parses a number of bytes with an optional
+// K, M or G suffix denoting a power of 1024.
+func parseByteSize(s string) (uint64, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<64-1)>>shift {
+		return 0, fmt.Errorf("size out of range")
+	}
+	return n << shift, nil
+}
+
+// parseCPUTime parses a CPU time as either a whole number of seconds
+// or a duration, which is rounded up to a whole number of seconds
+// as required by RLIMIT_CPU.
+func parseCPUTime(s string) (uint64, error) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("non-positive duration")
+	}
+	return uint64((d + time.Second - 1) / time.Second), nil
+}
+
+// formatBytes formats a number of bytes for display, using
+// the same suffixes as parseByteSize.
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d", n)
+}
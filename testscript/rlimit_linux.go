@@ -0,0 +1,88 @@
+package testscript
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimitResources = map[string]int{
+	"as":     unix.RLIMIT_AS,
+	"cpu":    unix.RLIMIT_CPU,
+	"nofile": unix.RLIMIT_NOFILE,
+}
+
+// When a program is run with resource limits, the current executable
+// is run in its place with these environment variables set. Before
+// anything else happens, the init function below applies the limits
+// to the process and then executes the program, so that the program
+// never runs without them.
+const (
+	rlimitEnv     = "TESTSCRIPT_RLIMITS"     // the limits, as for exec -rlimit
+	rlimitProgEnv = "TESTSCRIPT_RLIMIT_PROG" // the path of the program
+)
+
+func init() {
+	limits, ok := os.LookupEnv(rlimitEnv)
+	if !ok {
+		return
+	}
+	prog := os.Getenv(rlimitProgEnv)
+	os.Unsetenv(rlimitEnv)
+	os.Unsetenv(rlimitProgEnv)
+	err := execWithRlimits(prog, limits)
+	fmt.Fprintf(os.Stderr, "testscript: cannot run %s: %v\n", prog, err)
+	os.Exit(127)
+}
+
+// execWithRlimits applies the limits to the current process and
+// replaces it with prog, passing the same arguments and environment.
+// It returns only if that fails.
+func execWithRlimits(prog, spec string) error {
+	limits, err := parseRlimits(spec)
+	if err != nil {
+		return err
+	}
+	for _, l := range limits {
+		// Set both the soft and the hard limit,
+		// so that the program cannot raise them again.
+		lim := unix.Rlimit{Cur: l.value, Max: l.value}
+		if err := unix.Prlimit(0, rlimitResources[l.name], &lim, nil); err != nil {
+			return fmt.Errorf("cannot set %s limit: %v", l.name, err)
+		}
+	}
+	return unix.Exec(prog, os.Args, os.Environ())
+}
+
+// setRlimits arranges for cmd, which has not yet been started,
+// to run with the given limits.
+func setRlimits(cmd *exec.Cmd, limits []rlimit) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot apply resource limits: %v", err)
+	}
+	cmd.Env = append(cmd.Env,
+		rlimitEnv+"="+formatRlimits(limits),
+		rlimitProgEnv+"="+cmd.Path,
+	)
+	cmd.Path = self
+	return nil
+}
+
+// processUsage describes the CPU time and peak memory use of
+// an exited process.
+func processUsage(state *os.ProcessState) string {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return ""
+	}
+	// Maxrss is measured in kilobytes on Linux.
+	return fmt.Sprintf("user %v, system %v, max rss %s",
+		state.UserTime().Round(time.Millisecond),
+		state.SystemTime().Round(time.Millisecond),
+		formatBytes(uint64(ru.Maxrss)*1024))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package testscript
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func setRlimits(cmd *exec.Cmd, limits []rlimit) error {
+	return fmt.Errorf("resource limits are only supported on Linux")
+}
+
+func processUsage(state *os.ProcessState) string {
+	return ""
+}
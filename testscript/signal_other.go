@@ -0,0 +1,14 @@
+//go:build !unix
+
+package testscript
+
+import "os"
+
+var signals = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"KILL": os.Kill,
+}
+
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
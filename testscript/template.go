@@ -0,0 +1,163 @@
+package testscript
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Template describes a directory tree that is built once and then
+// copied into the work directory of every script. It is useful when
+// each script needs the same large set of files, such as vendored
+// modules or prebuilt binaries, which would be slow to create
+// for every script in Params.Setup.
+type Template struct {
+	// Build populates the empty directory dir with the contents
+	// of the template. It is called at most once per call to RunT.
+	Build func(dir string) error
+
+	// Hash, if not empty, identifies the contents of the template,
+	// for example by hashing the inputs used by Build. When it is set,
+	// the built template is kept in CacheDir and reused by later test
+	// runs with the same Hash, so that Build is only called again
+	// when Hash changes.
+	Hash string
+
+	// CacheDir holds the directory in which templates are kept when
+	// Hash is set. If it is empty, a testscript directory inside
+	// os.UserCacheDir is used. Templates for old values of Hash
+	// are not removed automatically.
+	CacheDir string
+}
+
+// build returns the directory holding the template's contents,
+// calling Build if necessary. Templates without a Hash are built
+// inside tempDir.
+func (tmpl *Template) build(tempDir string) (string, error) {
+	if tmpl.Hash == "" {
+		dir := filepath.Join(tempDir, "template")
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			return "", err
+		}
+		return dir, tmpl.Build(dir)
+	}
+	cacheDir := tmpl.CacheDir
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCacheDir, "testscript", "template")
+	}
+	// Hash the user's hash so that it need not be a valid file name.
+	sum := sha256.Sum256([]byte(tmpl.Hash))
+	dir := filepath.Join(cacheDir, hex.EncodeToString(sum[:16]))
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return dir, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0o777); err != nil {
+		return "", err
+	}
+	// Build in a temporary directory and rename it into place,
+	// so that a partially built template is never used.
+	tmpDir, err := os.MkdirTemp(cacheDir, "build-")
+	if err != nil {
+		return "", err
+	}
+	if err := tmpl.Build(tmpDir); err != nil {
+		removeAll(tmpDir)
+		return "", err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		removeAll(tmpDir)
+		// Another test process may have built the same
+		// template concurrently.
+		if info, err1 := os.Stat(dir); err1 == nil && info.IsDir() {
+			return dir, nil
+		}
+		return "", fmt.Errorf("cannot move template into cache: %v", err)
+	}
+	return dir, nil
+}
+
+// copyTree copies the contents of the directory src into the existing
+// directory dst, cloning regular files where possible so that
+// large trees can be copied cheaply.
+func copyTree(src, dst string) error {
+	type dirPerm struct {
+		path string
+		perm fs.FileMode
+	}
+	var dirs []dirPerm
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			// Create directories writable so that they can be filled,
+			// and set their actual permissions afterwards.
+			dirs = append(dirs, dirPerm{target, info.Mode().Perm()})
+			return os.Mkdir(target, 0o777)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a regular file, using a copy-on-write clone when the
+// file system supports it, and falling back to copying its contents.
+//
+// Unlike copyBinary, it never uses hard links, as scripts are free
+// to modify the files in their work directory.
+func copyFile(from, to string, perm fs.FileMode) error {
+	if err := cloneFile(from, to, perm, false); err == nil {
+		return nil
+	}
+	reader, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -16,6 +16,7 @@ import (
 	"go/build"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -24,6 +25,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
@@ -142,6 +144,21 @@ type Params struct {
 	// a directory.
 	Files []string
 
+	// Template, if not nil, describes a directory tree that is built
+	// once per call to RunT and copied into each script's work directory
+	// before the script's files are extracted and Setup is called.
+	Template *Template
+
+	// Executables maps command names to the paths of programs to make
+	// available to scripts under those names. Each program is copied
+	// once per call to RunT into a directory that is added to the
+	// front of $PATH, so that it can be run with exec as well as
+	// directly by name, like the commands registered with [Main],
+	// without scripts having to know where it is installed.
+	// Commands in Params.Commands take precedence over those
+	// added for Executables.
+	Executables map[string]string
+
 	// Setup is called, if not nil, to complete any setup required
 	// for a test. The WorkDir and Vars fields will have already
 	// been initialized and all the files extracted into WorkDir,
@@ -154,10 +171,29 @@ type Params struct {
 	// standard set, and may be nil.
 	Condition func(cond string) (bool, error)
 
+	// Conditions holds a map of documented conditions available to
+	// the script. A name ending in a colon, such as "docker:", matches
+	// any condition with that prefix. It's consulted only for conditions
+	// not in the standard set, and before Condition is called.
+	Conditions map[string]Cond
+
+	// ReleaseTags holds the release tags, such as "go1.21", that
+	// determine which [go1.x] conditions are satisfied. If it is nil,
+	// the release tags of the Go version that built the test binary
+	// are used.
+	ReleaseTags []string
+
 	// Cmds holds a map of commands available to the script.
 	// It will only be consulted for commands not part of the standard set.
 	Cmds map[string]func(ts *TestScript, neg bool, args []string)
 
+	// Commands holds a map of documented commands available to the
+	// script. Like Cmds, it will only be consulted for commands not
+	// part of the standard set, and it takes precedence over Cmds.
+	// The usage of each command is checked against its documentation
+	// before the command is run.
+	Commands map[string]Cmd
+
 	// TestWork specifies that working directories should be
 	// left intact for later inspection.
 	TestWork bool
@@ -176,11 +212,26 @@ type Params struct {
 	// succeed and the testscript file will be updated to reflect the actual
 	// content (which could be stdout, stderr or a real file).
 	//
+	// If the second argument refers to a file that does not exist, it is
+	// created: a file in $WORK is added to the end of the testscript file,
+	// and a file in $SCRIPTDIR or one of its subdirectories is written
+	// directly. Files in $SCRIPTDIR are also overwritten when they differ.
+	// Files anywhere else are never written.
+	//
 	// The content will be quoted with txtar.Quote if needed;
 	// a manual change will be needed if it is not unquoted in the
 	// script.
 	UpdateScripts bool
 
+	// UpdateMatches specifies that if a `stdout` or `stderr` command fails
+	// to find a match, and its pattern is literal text (with no regular
+	// expression metacharacters, or using the -exact flag), the command
+	// will succeed and its line in the testscript file will be rewritten
+	// to use the line of output most similar to the pattern. Each such
+	// rewrite is logged. Patterns containing environment variables are
+	// never rewritten.
+	UpdateMatches bool
+
 	// RequireExplicitExec requires that commands passed to [Main] must be used
 	// in test scripts via `exec cmd` and not simply `cmd`. This can help keep
 	// consistency across test scripts as well as keep separate process
@@ -196,12 +247,87 @@ type Params struct {
 	// will continue as if in verbose mode.
 	ContinueOnError bool
 
+	// IsolatedHome causes each script to be given its own writable home
+	// directory, $WORK/.home, instead of the nonexistent /no-home. The
+	// XDG_CONFIG_HOME, XDG_CACHE_HOME and XDG_DATA_HOME environment
+	// variables are set to directories within it, as are APPDATA and
+	// LOCALAPPDATA on Windows. Files in the archive with names
+	// starting ".home/" are unpacked into the home directory.
+	IsolatedHome bool
+
+	// CoverDir, if not empty, gives each script its own coverage data
+	// directory, CoverDir/scripts/<name>, used as GOCOVERDIR by the
+	// commands registered with [Main]. This only has an effect when the
+	// test binary is built with coverage enabled, for example with
+	// "go test -cover". A relative CoverDir is interpreted relative to
+	// the current directory, not to $WORK.
+	//
+	// When all the scripts have finished, a report is written to
+	// CoverDir/report.txt listing the functions covered by each script,
+	// the scripts that cover no function that other scripts do not, and
+	// the functions that no script covers. Writing the report requires
+	// the go command. The coverage data is also copied to any GOCOVERDIR
+	// that the test itself is using, so that "go test -coverprofile"
+	// still reports the coverage from all the scripts.
+	CoverDir string
+
+	// FailOnLeakedProcesses causes a script to fail if any process
+	// started by exec, or by a process that it started in turn, is
+	// still running when the script ends. Such processes are killed
+	// whether or not this is set; only when it is set are they looked
+	// for, which involves scanning /proc where it is available.
+	//
+	// Each command run by exec runs in its own process group, and
+	// the interrupt and kill signals sent to a command are sent to
+	// the whole group. Processes that start a new process group or
+	// session of their own are not tracked. Process groups are only
+	// supported on Unix-like systems.
+	FailOnLeakedProcesses bool
+
+	// Debug, if non-nil, is called as each script runs: before each
+	// phase comment and statement, and after a statement fails,
+	// before any background commands are stopped or the work
+	// directory is removed. It is intended for interactive debuggers,
+	// which can inspect the script through ts while the call blocks.
+	Debug func(ts *TestScript, ev DebugEvent)
+
 	// Deadline, if not zero, specifies the time at which the test run will have
 	// exceeded the timeout. It is equivalent to testing.T's Deadline method,
 	// and Run will set it to the method's return value if this field is zero.
 	Deadline time.Time
 }
 
+// DebugEvent describes the point that a script has reached
+// when [Params.Debug] is called.
+type DebugEvent struct {
+	// Kind holds the kind of event.
+	Kind DebugKind
+
+	// File and Line give the position of the statement in the script.
+	File string
+	Line int
+
+	// Text holds the statement as written in the script. For an if or
+	// retry block it holds just the opening line.
+	Text string
+
+	// Output holds what the statement logged. It is only set for
+	// DebugFail events.
+	Output string
+}
+
+// DebugKind is the kind of a [DebugEvent].
+type DebugKind int
+
+const (
+	// DebugPhase is reported before a comment that starts a new phase.
+	DebugPhase DebugKind = iota
+	// DebugStep is reported before a statement runs.
+	DebugStep
+	// DebugFail is reported after a statement fails the script.
+	DebugFail
+)
+
 // RunDir runs the tests in the given directory. All files in dir with a ".txt"
 // or ".txtar" extension are considered to be test files.
 func Run(t *testing.T, p Params) {
@@ -287,6 +413,14 @@ func RunT(t T, p Params) {
 		t.Fatal(err)
 	}
 
+	var templateDir string
+	if p.Template != nil {
+		templateDir, err = p.Template.build(testTempDir)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("cannot build template: %v", err))
+		}
+	}
+
 	var (
 		ctx         = context.Background()
 		gracePeriod = 100 * time.Millisecond
@@ -317,6 +451,50 @@ func RunT(t T, p Params) {
 		_ = cancel
 	}
 
+	// The directory holding Params.Executables is removed by the
+	// last script to finish, or by Cleanup when it is available,
+	// for the same reason as the coverage report below.
+	var binDir string
+	removeBinDir := false
+	if len(p.Executables) > 0 {
+		binDir, err = installExecutables(&p, testTempDir)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("cannot install executables: %v", err))
+		}
+		if c, ok := t.(interface{ Cleanup(func()) }); ok {
+			c.Cleanup(func() {
+				if !p.TestWork && !*testWork {
+					removeAll(binDir)
+					os.Remove(testTempDir)
+				}
+			})
+		} else {
+			removeBinDir = true
+		}
+	}
+
+	// With CoverDir set, the coverage report is written once all the
+	// scripts have finished. Use Cleanup when it is available, as the
+	// reference count below never reaches zero if some scripts are
+	// not run, for example because of the -run flag.
+	var coverage *coverageRun
+	if p.CoverDir != "" {
+		// GOCOVERDIR is used by commands running in $WORK,
+		// so a relative directory must not be passed on as is.
+		p.CoverDir, err = filepath.Abs(p.CoverDir)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("cannot find coverage directory: %v", err))
+		}
+		coverage = &coverageRun{dir: p.CoverDir}
+		if c, ok := t.(interface{ Cleanup(func()) }); ok {
+			c.Cleanup(func() {
+				coverage.finish(t)
+			})
+		} else {
+			coverage.onLast = true
+		}
+	}
+
 	refCount := int32(len(files))
 	names := make(map[string]bool)
 	for _, file := range files {
@@ -340,9 +518,14 @@ func RunT(t T, p Params) {
 		names[name] = true
 		t.Run(name, func(t T) {
 			t.Parallel()
+			if coverage != nil {
+				coverage.add(name)
+			}
 			ts := &TestScript{
 				t:             t,
 				testTempDir:   testTempDir,
+				templateDir:   templateDir,
+				binDir:        binDir,
 				name:          name,
 				file:          file,
 				params:        p,
@@ -351,15 +534,26 @@ func RunT(t T, p Params) {
 				deferred:      func() {},
 				scriptFiles:   make(map[string]string),
 				scriptUpdates: make(map[string]string),
+				lineUpdates:   make(map[int]string),
 			}
 			defer func() {
+				last := atomic.AddInt32(&refCount, -1) == 0
+				if last && coverage != nil && coverage.onLast {
+					coverage.finish(t)
+				}
 				if p.TestWork || *testWork {
 					return
 				}
 				removeAll(ts.workdir)
-				if atomic.AddInt32(&refCount, -1) == 0 {
+				if last {
 					// This is the last subtest to finish. Remove the
 					// parent directory too, and cancel the context.
+					if templateDir != "" && p.Template.Hash == "" {
+						removeAll(templateDir)
+					}
+					if removeBinDir {
+						removeAll(binDir)
+					}
 					os.Remove(testTempDir)
 					if cancel != nil {
 						cancel()
@@ -376,6 +570,8 @@ type TestScript struct {
 	params        Params
 	t             T
 	testTempDir   string
+	templateDir   string            // directory holding Params.Template, if any
+	binDir        string            // directory holding Params.Executables, if any
 	workdir       string            // temporary work dir ($WORK)
 	log           bytes.Buffer      // test execution log (printed at end of test)
 	mark          int               // offset of next log truncation
@@ -394,12 +590,17 @@ type TestScript struct {
 	stdinPty      bool              // connect pty to standard input; set by 'ttyin -stdin' command
 	ttyout        string            // terminal output; for 'ttyout' command
 	stopped       bool              // test wants to stop early
+	tentative     bool              // running a retry attempt that may be repeated
 	start         time.Time         // time phase started
 	background    []backgroundCmd   // backgrounded 'exec' and 'go' commands
+	procGroups    []*procGroup      // process groups started by 'exec'
+	rlimits       []rlimit          // resource limits for next 'exec' command; set by 'exec -rlimit'
 	deferred      func()            // deferred cleanup actions.
+	deferFailed   bool              // a command queued by 'defer' failed.
 	archive       *txtar.Archive    // the testscript being run.
 	scriptFiles   map[string]string // files stored in the txtar archive (absolute paths -> path in script)
 	scriptUpdates map[string]string // updates to testscript files via UpdateScripts.
+	lineUpdates   map[int]string    // updates to script lines via UpdateMatches, by line number.
 
 	// runningBuiltin indicates if we are running a user-supplied builtin
 	// command. These commands are specified via Params.Cmds.
@@ -417,10 +618,14 @@ type TestScript struct {
 }
 
 type backgroundCmd struct {
-	name string
-	cmd  *exec.Cmd
-	wait <-chan struct{}
-	neg  bool // if true, cmd should fail
+	name  string
+	cmd   *exec.Cmd
+	group *procGroup
+	wait  <-chan struct{}
+	neg   bool // if true, cmd should fail
+	// usage is set when the resource usage of cmd
+	// should be logged, because it was run with limits.
+	usage bool
 }
 
 func writeFile(name string, data []byte, perm fs.FileMode, excl bool) error {
@@ -462,13 +667,33 @@ func (ts *TestScript) setup() string {
 	tmpDir := filepath.Join(ts.workdir, ".tmp")
 
 	ts.Check(os.MkdirAll(tmpDir, 0o777))
+	if ts.templateDir != "" {
+		ts.Check(copyTree(ts.templateDir, ts.workdir))
+	}
+	scriptDir, err := filepath.Abs(filepath.Dir(ts.file))
+	ts.Check(err)
+	homeDir := "/no-home"
+	var homeVars []string
+	if ts.params.IsolatedHome {
+		homeDir = filepath.Join(ts.workdir, ".home")
+		homeVars = isolatedHomeVars(homeDir)
+		for _, kv := range homeVars {
+			_, dir, _ := strings.Cut(kv, "=")
+			ts.Check(os.MkdirAll(dir, 0o777))
+		}
+	}
+	path := os.Getenv("PATH")
+	if ts.binDir != "" {
+		path = ts.binDir + string(filepath.ListSeparator) + path
+	}
 	env := &Env{
 		Vars: []string{
 			"WORK=" + ts.workdir, // must be first for ts.abbrev
-			"PATH=" + os.Getenv("PATH"),
+			"PATH=" + path,
 			"GOTRACEBACK=system",
-			homeEnvName() + "=/no-home",
+			homeEnvName() + "=" + homeDir,
 			tempEnvName() + "=" + tmpDir,
+			"SCRIPTDIR=" + scriptDir,
 			"devnull=" + os.DevNull,
 			"/=" + string(os.PathSeparator),
 			":=" + string(os.PathListSeparator),
@@ -490,10 +715,21 @@ func (ts *TestScript) setup() string {
 		// such as GORACE=atexit_sleep_ms=10 to avoid the default 1s sleeps.
 		"GORACE",
 	} {
+		if name == "GOCOVERDIR" && ts.params.CoverDir != "" {
+			continue
+		}
 		if val := os.Getenv(name); val != "" {
 			env.Vars = append(env.Vars, name+"="+val)
 		}
 	}
+	if ts.params.CoverDir != "" {
+		coverDir := scriptCoverDir(ts.params.CoverDir, ts.name)
+		// Discard any data left by a previous run.
+		ts.Check(removeAll(coverDir))
+		ts.Check(os.MkdirAll(coverDir, 0o777))
+		env.Vars = append(env.Vars, "GOCOVERDIR="+coverDir)
+	}
+	env.Vars = append(env.Vars, homeVars...)
 	if runtime.GOOS == "windows" {
 		env.Vars = append(env.Vars, "exe=.exe")
 	} else {
@@ -561,12 +797,27 @@ func (ts *TestScript) run() {
 	// but an earlier block _did_ fail, in the case of ContinueOnError.
 	lastBlockFailed := false
 
+	// The deferred functions below run in reverse order, so that an early
+	// return cleans up in the same order as a normal exit from the test loop:
+	// background processes first, then deferred actions, then any processes
+	// left behind. Each is a separate defer so that the log is still flushed
+	// if a deferred action panics.
+	defer func() {
+		ts.reapProcessGroups()
+
+		markTime()
+		// Flush testScript log to testing.T log.
+		ts.t.Log(ts.abbrev(ts.log.String()))
+	}()
+	defer func() {
+		ts.deferred()
+	}()
 	defer func() {
 		// On a normal exit from the test loop, background processes are cleaned up
 		// before we print PASS. If we return early (e.g., due to a test failure),
 		// don't print anything about the processes that were still running.
 		for _, bg := range ts.background {
-			interruptProcess(bg.cmd.Process)
+			bg.group.interrupt()
 		}
 		if ts.t.Verbose() || failed {
 			// In verbose mode or on test failure, we want to see what happened in the background
@@ -578,13 +829,6 @@ func (ts *TestScript) run() {
 			}
 			ts.background = nil
 		}
-
-		markTime()
-		// Flush testScript log to testing.T log.
-		ts.t.Log(ts.abbrev(ts.log.String()))
-	}()
-	defer func() {
-		ts.deferred()
 	}()
 	script := ts.setup()
 
@@ -597,68 +841,144 @@ func (ts *TestScript) run() {
 	}
 	defer ts.applyScriptUpdates()
 
-	// Run script.
-	// See testdata/script/README for documentation of script form.
-	for script != "" {
-		// Extract next line.
-		ts.lineno++
-		var line string
-		if before, after, ok := strings.Cut(script, "\n"); ok {
-			line, script = before, after
+	// Parse the script into statements so that blocks are
+	// checked before anything runs.
+	var stmts []*scriptStmt
+	func() {
+		defer catchFailNow(func() {
+			failed = true
+			ts.t.FailNow()
+		})
+		stmts = ts.parseScript(script)
+	}()
+
+	// lineFailed records the failure of a line, returning false when the
+	// failure should abort the enclosing statements. When tentative is
+	// true, the statements are being run by a retry block which will
+	// run them again, so the failure does not fail the script.
+	// stmtLog holds the length of the log when the current statement
+	// started, so that its output can be passed to Params.Debug.
+	stmtLog := 0
+	lineFailed := func(st *scriptStmt, tentative bool) bool {
+		if tentative {
+			return false
+		}
+		ts.debug(DebugFail, st, ts.log.String()[stmtLog:])
+		failed = true
+		lastBlockFailed = true
+		if ts.params.ContinueOnError {
+			verbose = true
 		} else {
-			line, script = script, ""
+			ts.t.FailNow()
 		}
+		return true
+	}
 
-		// # is a comment indicating the start of new phase.
-		if strings.HasPrefix(line, "#") {
-			// If there was a previous phase, it succeeded,
-			// so rewind the log to delete its details (unless -v is in use or
-			// ContinueOnError was enabled and there was a previous error,
-			// causing verbose to be set to true).
-			// If nothing has happened at all since the mark,
-			// rewinding is a no-op and adding elapsed time
-			// for doing nothing is meaningless, so don't.
-			if ts.log.Len() > ts.mark {
-				rewind()
-				markTime()
+	// Run script.
+	// See testdata/script/README for documentation of script form.
+	var runStmts func(stmts []*scriptStmt, tentative bool) bool
+	runStmts = func(stmts []*scriptStmt, tentative bool) bool {
+		for _, st := range stmts {
+			ts.lineno = st.lineno
+			ts.tentative = tentative
+			if st.kind == stmtComment {
+				ts.debug(DebugPhase, st, "")
+			} else {
+				ts.debug(DebugStep, st, "")
 			}
+			stmtLog = ts.log.Len()
+			switch st.kind {
+			case stmtComment:
+				// # is a comment indicating the start of new phase.
+				// If there was a previous phase, it succeeded,
+				// so rewind the log to delete its details (unless -v is in use or
+				// ContinueOnError was enabled and there was a previous error,
+				// causing verbose to be set to true).
+				// If nothing has happened at all since the mark,
+				// rewinding is a no-op and adding elapsed time
+				// for doing nothing is meaningless, so don't.
+				if ts.log.Len() > ts.mark {
+					rewind()
+					markTime()
+				}
 
-			// "Reset" verbose in the case that we are using ContinueOnError
-			// so that the next block only shows verbose output in case it
-			// is also in error. This ensures that later blocks that are not
-			// in error, do not needlessly show verbose output because of an
-			// earlier block that was in error.
-			verbose = ts.t.Verbose()
-			lastBlockFailed = false
-
-			// Print phase heading and mark start of phase output.
-			fmt.Fprintf(&ts.log, "%s\n", line)
-			ts.mark = ts.log.Len()
-			ts.start = time.Now()
-			continue
-		}
-
-		ok := ts.runLine(line)
-		if !ok {
-			failed = true
-			lastBlockFailed = true
-			if ts.params.ContinueOnError {
-				verbose = true
-			} else {
-				ts.t.FailNow()
+				// "Reset" verbose in the case that we are using ContinueOnError
+				// so that the next block only shows verbose output in case it
+				// is also in error. This ensures that later blocks that are not
+				// in error, do not needlessly show verbose output because of an
+				// earlier block that was in error.
+				verbose = ts.t.Verbose()
+				lastBlockFailed = false
+
+				// Print phase heading and mark start of phase output.
+				fmt.Fprintf(&ts.log, "%s\n", st.line)
+				ts.mark = ts.log.Len()
+				ts.start = time.Now()
+			case stmtLine:
+				if !ts.runLine(st.line) && !lineFailed(st, tentative) {
+					return false
+				}
+			case stmtIf:
+				taken, ok := ts.runIf(st.line)
+				if !ok {
+					if !lineFailed(st, tentative) {
+						return false
+					}
+					continue
+				}
+				body := st.body
+				if !taken {
+					body = st.elseBody
+					if st.elseLineno > 0 {
+						fmt.Fprintf(&ts.log, "> else\n")
+					}
+				}
+				if !runStmts(body, tentative) {
+					return false
+				}
+			case stmtRetry:
+				attempts, interval, ok := ts.runRetry(st.line)
+				if !ok {
+					if !lineFailed(st, tentative) {
+						return false
+					}
+					continue
+				}
+				for attempt := 1; ; attempt++ {
+					if attempt == attempts {
+						// The final attempt counts as usual.
+						if !runStmts(st.body, tentative) {
+							return false
+						}
+						break
+					}
+					if runStmts(st.body, true) || ts.stopped {
+						break
+					}
+					ts.lineno = st.lineno
+					ts.Logf("[attempt %d of %d failed; retrying after %v]", attempt, attempts, interval)
+					select {
+					case <-time.After(interval):
+					case <-ts.ctxt.Done():
+						// Let the final attempt report the timeout.
+						attempt = attempts - 1
+					}
+				}
 			}
-		}
 
-		// Command can ask script to stop early.
-		if ts.stopped {
-			// Break instead of returning, so that we check the status of any
-			// background processes and print PASS.
-			break
+			// Command can ask script to stop early.
+			if ts.stopped {
+				// Return instead of continuing, so that we check the status of any
+				// background processes and print PASS.
+				return true
+			}
 		}
+		return true
 	}
+	runStmts(stmts, false)
 
 	for _, bg := range ts.background {
-		interruptProcess(bg.cmd.Process)
+		bg.group.interrupt()
 	}
 	// On some platforms like Windows, we kill background commands directly
 	// as we can't send them an interrupt signal, so they always fail.
@@ -666,6 +986,21 @@ func (ts *TestScript) run() {
 	// Once we've reached the end of the script, ignore the status of background commands.
 	ts.waitBackground(false)
 
+	// Run deferred actions, including commands queued by the defer
+	// command, now rather than when run returns, so that a failing
+	// deferred command fails the test like any other command.
+	deferred := ts.deferred
+	ts.deferred = func() {}
+	deferred()
+	if ts.deferFailed {
+		failed = true
+		lastBlockFailed = true
+	}
+	if !ts.reapProcessGroups() {
+		failed = true
+		lastBlockFailed = true
+	}
+
 	if !lastBlockFailed {
 		rewind()
 	}
@@ -683,6 +1018,21 @@ func (ts *TestScript) run() {
 	}
 }
 
+// debug calls Params.Debug, if set, for the statement st.
+// Blank lines are not reported.
+func (ts *TestScript) debug(kind DebugKind, st *scriptStmt, output string) {
+	if ts.params.Debug == nil || strings.TrimSpace(st.line) == "" {
+		return
+	}
+	ts.params.Debug(ts, DebugEvent{
+		Kind:   kind,
+		File:   ts.file,
+		Line:   st.lineno,
+		Text:   st.line,
+		Output: output,
+	})
+}
+
 func (ts *TestScript) runLine(line string) (runOK bool) {
 	defer catchFailNow(func() {
 		runOK = false
@@ -698,24 +1048,20 @@ func (ts *TestScript) runLine(line string) (runOK bool) {
 	fmt.Fprintf(&ts.log, "> %s\n", line)
 
 	// Command prefix [cond] means only run this command if cond is satisfied.
-	for strings.HasPrefix(args[0], "[") && strings.HasSuffix(args[0], "]") {
-		cond := args[0]
-		cond = cond[1 : len(cond)-1]
-		cond = strings.TrimSpace(cond)
-		args = args[1:]
-		if len(args) == 0 {
-			ts.Fatalf("missing command after condition")
-		}
-		want := true
-		if strings.HasPrefix(cond, "!") {
-			want = false
-			cond = strings.TrimSpace(cond[1:])
+	// The condition may be an expression such as [linux || darwin], which
+	// will have been split into several words.
+	for strings.HasPrefix(args[0], "[") {
+		var cond string
+		cond, args = ts.cutCond(args)
+		expr, err := parseCondExpr(cond)
+		if err != nil {
+			ts.Fatalf("bad condition %q: %v", cond, err)
 		}
-		ok, err := ts.condition(cond)
+		ok, err := ts.evalCond(expr)
 		if err != nil {
 			ts.Fatalf("bad condition %q: %v", cond, err)
 		}
-		if ok != want {
+		if !ok {
 			// Don't run rest of line.
 			return true
 		}
@@ -733,28 +1079,65 @@ func (ts *TestScript) runLine(line string) (runOK bool) {
 	}
 
 	// Run command.
-	cmd := scriptCmds[args[0]]
-	if cmd == nil {
-		cmd = ts.params.Cmds[args[0]]
-	}
-	if cmd == nil {
-		// try to find spelling corrections. We arbitrarily limit the number of
-		// corrections, to not be too noisy.
-		switch c := ts.cmdSuggestions(args[0]); len(c) {
-		case 1:
-			ts.Fatalf("unknown command %q (did you mean %q?)", args[0], c[0])
-		case 2, 3, 4:
-			ts.Fatalf("unknown command %q (did you mean one of %q?)", args[0], c)
-		default:
-			ts.Fatalf("unknown command %q", args[0])
-		}
+	cmd, ok := ts.lookupCmd(args[0])
+	if !ok {
+		ts.unknownCmd(args[0])
 	}
+	ts.checkUsage(args[0], cmd, neg, args[1:])
 	ts.callBuiltinCmd(func() {
-		cmd(ts, neg, args[1:])
+		cmd.Run(ts, neg, args[1:])
 	})
 	return true
 }
 
+// cutCond splits the leading [cond] prefix from the arguments of a
+// line, returning the condition expression and the remaining arguments.
+func (ts *TestScript) cutCond(args []string) (cond string, rest []string) {
+	n := slices.IndexFunc(args, func(arg string) bool {
+		return strings.HasSuffix(arg, "]")
+	})
+	if n < 0 {
+		ts.Fatalf("unterminated condition")
+	}
+	cond = strings.Join(args[:n+1], " ")
+	cond = cond[1 : len(cond)-1]
+	cond = strings.TrimSpace(cond)
+	rest = args[n+1:]
+	if len(rest) == 0 {
+		ts.Fatalf("missing command after condition")
+	}
+	return cond, rest
+}
+
+// unknownCmd fails the script because of the unknown command name.
+func (ts *TestScript) unknownCmd(name string) {
+	// try to find spelling corrections. We arbitrarily limit the number of
+	// corrections, to not be too noisy.
+	switch c := ts.cmdSuggestions(name); len(c) {
+	case 1:
+		ts.Fatalf("unknown command %q (did you mean %q?)", name, c[0])
+	case 2, 3, 4:
+		ts.Fatalf("unknown command %q (did you mean one of %q?)", name, c)
+	default:
+		ts.Fatalf("unknown command %q", name)
+	}
+}
+
+// lookupCmd returns the command with the given name, looking first in
+// the standard set, then in Params.Commands and finally in Params.Cmds.
+func (ts *TestScript) lookupCmd(name string) (Cmd, bool) {
+	if cmd, ok := scriptCmds[name]; ok {
+		return cmd, true
+	}
+	if cmd, ok := ts.params.Commands[name]; ok {
+		return cmd, true
+	}
+	if run, ok := ts.params.Cmds[name]; ok {
+		return undocumentedCmd(run), true
+	}
+	return Cmd{}, false
+}
+
 func (ts *TestScript) callBuiltinCmd(runCmd func()) {
 	ts.runningBuiltin = true
 	defer func() {
@@ -775,20 +1158,12 @@ func (ts *TestScript) callBuiltinCmd(runCmd func()) {
 func (ts *TestScript) cmdSuggestions(name string) []string {
 	// special case: spell-correct `!cmd` to `! cmd`
 	if strings.HasPrefix(name, "!") {
-		if _, ok := scriptCmds[name[1:]]; ok {
-			return []string{"! " + name[1:]}
-		}
-		if _, ok := ts.params.Cmds[name[1:]]; ok {
+		if _, ok := ts.lookupCmd(name[1:]); ok {
 			return []string{"! " + name[1:]}
 		}
 	}
 	var candidates []string
-	for c := range scriptCmds {
-		if misspell.AlmostEqual(name, c) {
-			candidates = append(candidates, c)
-		}
-	}
-	for c := range ts.params.Cmds {
+	for c := range ts.params.AllCmds() {
 		if misspell.AlmostEqual(name, c) {
 			candidates = append(candidates, c)
 		}
@@ -802,9 +1177,18 @@ func (ts *TestScript) cmdSuggestions(name string) []string {
 }
 
 func (ts *TestScript) applyScriptUpdates() {
-	if len(ts.scriptUpdates) == 0 {
+	if len(ts.scriptUpdates) == 0 && len(ts.lineUpdates) == 0 {
 		return
 	}
+	if len(ts.lineUpdates) > 0 {
+		lines := strings.Split(string(ts.archive.Comment), "\n")
+		for _, lineno := range slices.Sorted(maps.Keys(ts.lineUpdates)) {
+			line := ts.lineUpdates[lineno]
+			lines[lineno-1] = line
+			ts.Logf("%s:%d: updated to %s", ts.file, lineno, strings.TrimSpace(line))
+		}
+		ts.archive.Comment = []byte(strings.Join(lines, "\n"))
+	}
 	for name, content := range ts.scriptUpdates {
 		found := false
 		for i := range ts.archive.Files {
@@ -852,44 +1236,74 @@ func catchFailNow(f func()) {
 
 // condition reports whether the given condition is satisfied.
 func (ts *TestScript) condition(cond string) (bool, error) {
+	if eval, ok := ts.builtinCond(cond); ok {
+		return eval(), nil
+	}
+	if c, suffix, ok := ts.lookupCond(cond); ok {
+		return c.Eval(ts, suffix)
+	}
+	if ts.params.Condition != nil {
+		return ts.params.Condition(cond)
+	}
+	ts.Fatalf("unknown condition %q", cond)
+	panic("unreachable")
+}
+
+// builtinCond returns a function that evaluates cond if it is one of
+// the built-in conditions documented in scriptConds.
+func (ts *TestScript) builtinCond(cond string) (eval func() bool, ok bool) {
 	switch {
 	case cond == "short":
-		return testing.Short(), nil
+		return testing.Short, true
 	case cond == "net":
-		return testenv.HasExternalNetwork(), nil
+		return testenv.HasExternalNetwork, true
 	case cond == "link":
-		return testenv.HasLink(), nil
+		return testenv.HasLink, true
 	case cond == "symlink":
-		return testenv.HasSymlink(), nil
+		return testenv.HasSymlink, true
 	case imports.KnownOS[cond]:
-		return cond == runtime.GOOS, nil
+		return func() bool { return cond == runtime.GOOS }, true
 	case cond == "unix":
-		return imports.UnixOS[runtime.GOOS], nil
+		return func() bool { return imports.UnixOS[runtime.GOOS] }, true
 	case imports.KnownArch[cond]:
-		return cond == runtime.GOARCH, nil
+		return func() bool { return cond == runtime.GOARCH }, true
 	case strings.HasPrefix(cond, "exec:"):
 		prog := cond[len("exec:"):]
-		ok := execCache.Do(prog, func() any {
-			_, err := execpath.Look(prog, ts.Getenv)
-			return err == nil
-		}).(bool)
-		return ok, nil
+		return func() bool {
+			return execCache.Do(prog, func() any {
+				_, err := execpath.Look(prog, ts.Getenv)
+				return err == nil
+			}).(bool)
+		}, true
 	case cond == "gc" || cond == "gccgo":
 		// TODO this reflects the compiler that the current
 		// binary was built with but not necessarily the compiler
 		// that will be used.
-		return cond == runtime.Compiler, nil
+		return func() bool { return cond == runtime.Compiler }, true
 	case goVersionRegex.MatchString(cond):
-		if slices.Contains(build.Default.ReleaseTags, cond) {
-			return true, nil
+		return func() bool {
+			tags := ts.params.ReleaseTags
+			if tags == nil {
+				tags = build.Default.ReleaseTags
+			}
+			return slices.Contains(tags, cond)
+		}, true
+	}
+	return nil, false
+}
+
+// lookupCond returns the condition from Params.Conditions matching cond,
+// along with the text following the colon for a prefix condition.
+func (ts *TestScript) lookupCond(cond string) (c Cond, suffix string, ok bool) {
+	if c, ok := ts.params.Conditions[cond]; ok && !strings.HasSuffix(cond, ":") {
+		return c, "", true
+	}
+	if prefix, suffix, ok := strings.Cut(cond, ":"); ok {
+		if c, ok := ts.params.Conditions[prefix+":"]; ok {
+			return c, suffix, true
 		}
-		return false, nil
-	case ts.params.Condition != nil:
-		return ts.params.Condition(cond)
-	default:
-		ts.Fatalf("unknown condition %q", cond)
-		panic("unreachable")
 	}
+	return Cond{}, "", false
 }
 
 // Helpers for command implementations.
@@ -988,12 +1402,20 @@ func (ts *TestScript) Logf(format string, args ...any) {
 // exec runs the given command line (an actual subprocess, not simulated)
 // in ts.cd with environment ts.env and then returns collected standard output and standard error.
 func (ts *TestScript) exec(command string, args ...string) (stdout, stderr string, err error) {
+	if procf := ts.inProcessCmd(command); procf != nil {
+		return ts.execInProcess(procf, command, args)
+	}
 	cmd, err := ts.buildExecCmd(command, args...)
 	if err != nil {
 		return "", "", err
 	}
 	cmd.Dir = ts.cd
 	cmd.Env = append(ts.env, "PWD="+ts.cd)
+	if len(ts.rlimits) > 0 {
+		if err := setRlimits(cmd, ts.rlimits); err != nil {
+			return "", "", err
+		}
+	}
 	cmd.Stdin = strings.NewReader(ts.stdin)
 	var stdoutBuf, stderrBuf strings.Builder
 	cmd.Stdout = &stdoutBuf
@@ -1027,8 +1449,13 @@ func (ts *TestScript) exec(command string, args ...string) (stdout, stderr strin
 			cmd.Stdin = tty
 		}
 	}
-	if err = cmd.Start(); err == nil {
-		err = waitOrStop(ts.ctxt, cmd, ts.gracePeriod)
+	setProcessGroup(cmd)
+	var g *procGroup
+	if g, err = ts.startCmd(cmd); err == nil {
+		err = waitOrStop(ts.ctxt, cmd, g, ts.gracePeriod)
+		if len(ts.rlimits) > 0 {
+			ts.logUsage(cmd.ProcessState)
+		}
 	}
 	ts.stdin = ""
 	ts.stdinPty = false
@@ -1037,22 +1464,142 @@ func (ts *TestScript) exec(command string, args ...string) (stdout, stderr strin
 
 // execBackground starts the given command line (an actual subprocess, not simulated)
 // in ts.cd with environment ts.env.
-func (ts *TestScript) execBackground(command string, args ...string) (*exec.Cmd, error) {
+func (ts *TestScript) execBackground(command string, args ...string) (*exec.Cmd, *procGroup, error) {
 	if ts.ttyin != "" {
-		return nil, errors.New("ttyin is not supported by background commands")
+		return nil, nil, errors.New("ttyin is not supported by background commands")
 	}
 	cmd, err := ts.buildExecCmd(command, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	cmd.Dir = ts.cd
 	cmd.Env = append(ts.env, "PWD="+ts.cd)
+	if len(ts.rlimits) > 0 {
+		if err := setRlimits(cmd, ts.rlimits); err != nil {
+			return nil, nil, err
+		}
+	}
 	var stdoutBuf, stderrBuf strings.Builder
 	cmd.Stdin = strings.NewReader(ts.stdin)
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
 	ts.stdin = ""
-	return cmd, cmd.Start()
+	setProcessGroup(cmd)
+	g, err := ts.startCmd(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, g, nil
+}
+
+// logUsage logs the resource usage of a command run with exec -rlimit.
+// As it is part of the log, the usage is also included in any
+// structured output produced from the log, such as by
+// "testscript -json".
+func (ts *TestScript) logUsage(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	if usage := processUsage(state); usage != "" {
+		ts.Logf("[usage: %s]", usage)
+	}
+}
+
+// procGroup records the process group of a command started by exec,
+// which is led by the command's process.
+type procGroup struct {
+	proc   *os.Process
+	lineno int // script line that started the group
+
+	mu        sync.Mutex
+	exited    bool // the leader has exited
+	remaining bool // processes remained in the group after the leader was reaped
+}
+
+// signal sends sig to the processes in the group. Like
+// os.Process.Signal, it returns os.ErrProcessDone once the
+// leader has exited.
+func (g *procGroup) signal(sig os.Signal) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.exited {
+		return os.ErrProcessDone
+	}
+	return signalGroup(g.proc, sig)
+}
+
+// interrupt sends os.Interrupt to the group if supported,
+// or os.Kill otherwise.
+func (g *procGroup) interrupt() {
+	if err := g.signal(os.Interrupt); err != nil && err != os.ErrProcessDone {
+		// Per https://golang.org/pkg/os/#Signal, “Interrupt is not implemented on
+		// Windows; using it with os.Process.Signal will return an error.”
+		// Fall back to Kill instead.
+		g.signal(os.Kill)
+	}
+}
+
+// setExited records that the leader of the group has exited,
+// so that the group is no longer signalled by signal.
+func (g *procGroup) setExited() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.exited = true
+}
+
+// reaped records whether any processes remain in the group just
+// after its leader has been reaped. While they do, the ID of the
+// group cannot be reused, and when they do not, reapProcessGroups
+// need not signal the group, which might by then belong to another
+// process.
+func (g *procGroup) reaped() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.exited = true
+	g.remaining = groupRunning(g.proc.Pid)
+}
+
+// startCmd starts cmd, recording its process group.
+func (ts *TestScript) startCmd(cmd *exec.Cmd) (*procGroup, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	g := &procGroup{proc: cmd.Process, lineno: ts.lineno}
+	ts.procGroups = append(ts.procGroups, g)
+	return g, nil
+}
+
+// reapProcessGroups kills any processes left running in the process
+// groups started by the script. If Params.FailOnLeakedProcesses is set,
+// it logs any such processes and reports whether there were none.
+func (ts *TestScript) reapProcessGroups() bool {
+	groups := ts.procGroups
+	ts.procGroups = nil
+	ok := true
+	for _, g := range groups {
+		g.mu.Lock()
+		remaining := g.remaining
+		g.mu.Unlock()
+		if !remaining {
+			continue
+		}
+		pgid := g.proc.Pid
+		if ts.params.FailOnLeakedProcesses {
+			procs := groupProcesses(pgid)
+			// Processes that have just been interrupted
+			// may take a short while to exit.
+			for i := 0; len(procs) > 0 && i < 10; i++ {
+				time.Sleep(10 * time.Millisecond)
+				procs = groupProcesses(pgid)
+			}
+			if len(procs) > 0 {
+				fmt.Fprintf(&ts.log, "FAIL: %s:%d: leaked processes: %s\n", ts.file, g.lineno, strings.Join(procs, ", "))
+				ok = false
+			}
+		}
+		killGroup(pgid)
+	}
+	return ok
 }
 
 func (ts *TestScript) buildExecCmd(command string, args ...string) (*exec.Cmd, error) {
@@ -1097,10 +1644,15 @@ func (ts *TestScript) Chdir(dir string) error {
 
 // waitOrStop waits for the already-started command cmd by calling its Wait method.
 //
-// If cmd does not return before ctx is done, waitOrStop sends it an interrupt
-// signal. If killDelay is positive, waitOrStop waits that additional period for
-// Wait to return before sending os.Kill.
-func waitOrStop(ctx context.Context, cmd *exec.Cmd, killDelay time.Duration) error {
+// If cmd does not return before ctx is done, waitOrStop sends an interrupt
+// signal to its process group g. If killDelay is positive, waitOrStop waits
+// that additional period for Wait to return before sending os.Kill.
+//
+// Where possible, g stops being signalled as soon as cmd exits, before it
+// is reaped by Wait, so that its process ID, which is also the ID of the
+// group, cannot have been reused by another process group when it is
+// signalled.
+func waitOrStop(ctx context.Context, cmd *exec.Cmd, g *procGroup, killDelay time.Duration) error {
 	if cmd.Process == nil {
 		panic("waitOrStop called with a nil cmd.Process — missing Start call?")
 	}
@@ -1121,7 +1673,7 @@ func waitOrStop(ctx context.Context, cmd *exec.Cmd, killDelay time.Duration) err
 			interrupt = os.Kill
 		}
 
-		err := cmd.Process.Signal(interrupt)
+		err := g.signal(interrupt)
 		if err == nil {
 			err = ctx.Err() // Report ctx.Err() as the reason we interrupted.
 		} else if err == os.ErrProcessDone {
@@ -1146,29 +1698,23 @@ func waitOrStop(ctx context.Context, cmd *exec.Cmd, killDelay time.Duration) err
 			// Ignore any error: if cmd.Process has already terminated, we still
 			// want to send ctx.Err() (or the error from the Interrupt call)
 			// to properly attribute the signal that may have terminated it.
-			_ = cmd.Process.Kill()
+			_ = g.signal(os.Kill)
 		}
 
 		errc <- err
 	}()
 
+	if waitExited(cmd.Process) {
+		g.setExited()
+	}
 	waitErr := cmd.Wait()
+	g.reaped()
 	if interruptErr := <-errc; interruptErr != nil {
 		return interruptErr
 	}
 	return waitErr
 }
 
-// interruptProcess sends os.Interrupt to p if supported, or os.Kill otherwise.
-func interruptProcess(p *os.Process) {
-	if err := p.Signal(os.Interrupt); err != nil {
-		// Per https://golang.org/pkg/os/#Signal, “Interrupt is not implemented on
-		// Windows; using it with os.Process.Signal will return an error.”
-		// Fall back to Kill instead.
-		p.Kill()
-	}
-}
-
 // Exec runs the given command and saves its stdout and stderr so
 // they can be inspected by subsequent script commands.
 func (ts *TestScript) Exec(command string, args ...string) error {
@@ -1256,6 +1802,45 @@ func (ts *TestScript) Getenv(key string) string {
 	return ts.envMap[envvarname(key)]
 }
 
+// Environ returns the environment of the script,
+// in the form used by [exec.Cmd.Env].
+func (ts *TestScript) Environ() []string {
+	return slices.Clone(ts.env)
+}
+
+// Unsetenv removes the environment variable named by the key.
+func (ts *TestScript) Unsetenv(key string) {
+	key = envvarname(key)
+	ts.env = slices.DeleteFunc(slices.Clone(ts.env), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return envvarname(name) == key
+	})
+	delete(ts.envMap, key)
+}
+
+// WithEnv calls f with the given key=value pairs added to the
+// environment, and restores the environment when f returns, even if f
+// fails the script. It allows a user-supplied builtin command (declared
+// via Params.Cmds) to run another command with a modified environment
+// without affecting the rest of the script. Any changes made to the
+// environment by f are also discarded.
+func (ts *TestScript) WithEnv(vars []string, f func()) {
+	env, envMap := ts.env, maps.Clone(ts.envMap)
+	defer func() {
+		ts.env, ts.envMap = env, envMap
+	}()
+	// Avoid appending to the original slice's backing array.
+	ts.env = slices.Clip(ts.env)
+	for _, kv := range vars {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			ts.Fatalf("invalid environment variable setting %q", kv)
+		}
+		ts.Setenv(key, value)
+	}
+	f()
+}
+
 // parse parses a single line as a list of space-separated arguments
 // subject to environment variable expansion (but not resplitting).
 // Single quotes around text disable splitting and expansion.
@@ -1343,6 +1928,24 @@ func homeEnvName() string {
 	}
 }
 
+// isolatedHomeVars returns the environment variables that point
+// to the configuration, cache and data directories within the
+// home directory used by Params.IsolatedHome.
+func isolatedHomeVars(home string) []string {
+	vars := []string{
+		"XDG_CONFIG_HOME=" + filepath.Join(home, ".config"),
+		"XDG_CACHE_HOME=" + filepath.Join(home, ".cache"),
+		"XDG_DATA_HOME=" + filepath.Join(home, ".local", "share"),
+	}
+	if runtime.GOOS == "windows" {
+		vars = append(vars,
+			"APPDATA="+filepath.Join(home, "AppData", "Roaming"),
+			"LOCALAPPDATA="+filepath.Join(home, "AppData", "Local"),
+		)
+	}
+	return vars
+}
+
 func tempEnvName() string {
 	switch runtime.GOOS {
 	case "windows":
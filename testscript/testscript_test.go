@@ -9,12 +9,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -35,6 +38,16 @@ func fprintArgs() {
 	}
 }
 
+func printEnv() {
+	for _, name := range os.Args[1:] {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			value = "<unset>"
+		}
+		fmt.Printf("%s=%s\n", name, value)
+	}
+}
+
 func exitWithStatus() {
 	n, _ := strconv.Atoi(os.Args[1])
 	os.Exit(n)
@@ -69,18 +82,53 @@ func terminalPrompt() {
 	}
 }
 
+// procInfo is an in-process command that reports its arguments,
+// environment, directory and standard input, and whether it is
+// running in the test process, and then exits with the status
+// given by its STATUS environment variable.
+func procInfo(p *Proc) int {
+	// Main sets os.Args[0] to the command name in a subprocess.
+	fmt.Fprintf(p.Stdout, "in-process: %v\n", filepath.Base(os.Args[0]) != p.Args[0])
+	fmt.Fprintf(p.Stdout, "args: %q\n", p.Args[1:])
+	fmt.Fprintf(p.Stdout, "dir: %s\n", filepath.Base(p.Dir))
+	stdin, _ := io.ReadAll(p.Stdin)
+	fmt.Fprintf(p.Stdout, "stdin: %q\n", stdin)
+	status := 0
+	for _, kv := range p.Env {
+		if value, ok := strings.CutPrefix(kv, "STATUS="); ok {
+			status, _ = strconv.Atoi(value)
+		}
+		if value, ok := strings.CutPrefix(kv, "PANIC="); ok {
+			panic(value)
+		}
+		switch kv {
+		case "HANG=wait":
+			<-p.Context.Done()
+			fmt.Fprintf(p.Stderr, "stopped: %v\n", p.Context.Err())
+			return 1
+		case "HANG=ignore":
+			select {}
+		}
+	}
+	fmt.Fprintf(p.Stderr, "status: %d\n", status)
+	return status
+}
+
 func TestMain(m *testing.M) {
 	timeSince = func(t time.Time) time.Duration {
 		return 0
 	}
 
 	showVerboseEnv = false
-	Main(m, map[string]func(){
+	MainWithProcs(m, map[string]func(){
 		"printargs":      printArgs,
 		"fprintargs":     fprintArgs,
+		"printenv":       printEnv,
 		"status":         exitWithStatus,
 		"signalcatcher":  signalCatcher,
 		"terminalprompt": terminalPrompt,
+	}, map[string]func(p *Proc) int{
+		"procinfo": procInfo,
 	})
 }
 
@@ -177,6 +225,23 @@ func TestScripts(t *testing.T) {
 			"ensureSpecialVal": ensureSpecialVal,
 			"interrupt":        interrupt,
 			"waitfile":         waitFile,
+			"execenv": func(ts *TestScript, neg bool, args []string) {
+				if len(args) < 2 {
+					ts.Fatalf("usage: execenv key=value program [args...]")
+				}
+				ts.WithEnv(args[:1], func() {
+					ts.Check(ts.Exec(args[1], args[2:]...))
+				})
+			},
+			"settime": func(ts *TestScript, neg bool, args []string) {
+				if len(args) != 2 {
+					ts.Fatalf("usage: settime file unix-seconds")
+				}
+				secs, err := strconv.ParseInt(args[1], 10, 64)
+				ts.Check(err)
+				mtime := time.Unix(secs, 0)
+				ts.Check(os.Chtimes(ts.MkAbs(args[0]), mtime, mtime))
+			},
 			"testdefer": func(ts *TestScript, neg bool, args []string) {
 				testDeferCount++
 				n := testDeferCount
@@ -218,16 +283,37 @@ func TestScripts(t *testing.T) {
 				// Run testscript in testscript. Oooh! Meta!
 				fset := flag.NewFlagSet("testscript", flag.ContinueOnError)
 				fUpdate := fset.Bool("update", false, "update scripts when cmp fails")
+				fUpdateMatches := fset.Bool("update-matches", false, "update scripts when stdout or stderr fails")
 				fExplicitExec := fset.Bool("explicit-exec", false, "require explicit use of exec for commands")
 				fUniqueNames := fset.Bool("unique-names", false, "require unique names in txtar archive")
 				fVerbose := fset.Bool("v", false, "be verbose with output")
 				fContinue := fset.Bool("continue", false, "continue on error")
 				fFiles := fset.Bool("files", false, "specify files rather than a directory")
+				fFailLeaked := fset.Bool("fail-leaked", false, "fail on leaked processes")
+				fIsolatedHome := fset.Bool("isolated-home", false, "give each script a writable home directory")
+				fTimeout := fset.Duration("timeout", 0, "time out the scripts after the given duration")
+				fTemplate := fset.String("template", "", "copy the contents of `dir` into each script as a Template")
+				fTemplateHash := fset.String("template-hash", "", "set the hash of the template")
+				fTemplateCache := fset.String("template-cache", "", "cache the template in `dir`")
+				fDebug := fset.Bool("debug", false, "log the events passed to Params.Debug")
+				fReleaseTags := fset.String("release-tags", "", "set Params.ReleaseTags to the comma-separated `tags`")
+				var executables map[string]string
+				fset.Func("exe", "add `name=path` to Params.Executables", func(v string) error {
+					name, path, ok := strings.Cut(v, "=")
+					if !ok {
+						return fmt.Errorf("want name=path")
+					}
+					if executables == nil {
+						executables = make(map[string]string)
+					}
+					executables[name] = ts.MkAbs(path)
+					return nil
+				})
 				if err := fset.Parse(args); err != nil {
 					ts.Fatalf("failed to parse args for testscript: %v", err)
 				}
 				if fset.NArg() != 1 && !*fFiles {
-					ts.Fatalf("testscript [-v] [-continue] [-update] [-explicit-exec] [-files] <dir>|<file>...")
+					ts.Fatalf("testscript [-v] [-continue] [-update] [-update-matches] [-explicit-exec] [-fail-leaked] [-isolated-home] [-timeout=d] [-template=dir [-template-hash=h] [-template-cache=dir]] [-debug] [-exe=name=path...] [-release-tags=tags] [-files] <dir>|<file>...")
 				}
 				var files []string
 				var dir string
@@ -238,13 +324,57 @@ func TestScripts(t *testing.T) {
 				} else {
 					dir = ts.MkAbs(fset.Arg(0))
 				}
+				var deadline time.Time
+				if *fTimeout > 0 {
+					deadline = time.Now().Add(*fTimeout)
+				}
+				var releaseTags []string
+				if *fReleaseTags != "" {
+					releaseTags = strings.Split(*fReleaseTags, ",")
+				}
 				t := &fakeT{verbose: *fVerbose}
+				var template *Template
+				if *fTemplate != "" {
+					src := ts.MkAbs(*fTemplate)
+					template = &Template{
+						Build: func(dir string) error {
+							fmt.Fprintf(&t.log, "** build template **\n")
+							return copyTestTree(src, dir)
+						},
+						Hash: *fTemplateHash,
+					}
+					if *fTemplateCache != "" {
+						template.CacheDir = ts.MkAbs(*fTemplateCache)
+					}
+				}
+				var debug func(ts *TestScript, ev DebugEvent)
+				if *fDebug {
+					kinds := map[DebugKind]string{
+						DebugPhase: "phase",
+						DebugStep:  "step",
+						DebugFail:  "fail",
+					}
+					debug = func(ts *TestScript, ev DebugEvent) {
+						// Expand the statement in the script's environment,
+						// to show that it can be inspected during the call.
+						fmt.Fprintf(&t.log, "debug: %s %d: %s\n", kinds[ev.Kind], ev.Line, os.Expand(ev.Text, ts.Getenv))
+						for line := range strings.Lines(ev.Output) {
+							fmt.Fprintf(&t.log, "debug:\t%s", line)
+						}
+					}
+				}
 				func() {
 					defer catchAbort()
 					RunT(t, Params{
+						Deadline:            deadline,
+						Template:            template,
+						Debug:               debug,
+						Executables:         executables,
+						ReleaseTags:         releaseTags,
 						Dir:                 dir,
 						Files:               files,
 						UpdateScripts:       *fUpdate,
+						UpdateMatches:       *fUpdateMatches,
 						RequireExplicitExec: *fExplicitExec,
 						RequireUniqueNames:  *fUniqueNames,
 						Cmds: map[string]func(ts *TestScript, neg bool, args []string){
@@ -252,7 +382,29 @@ func TestScripts(t *testing.T) {
 							},
 							"echoandexit": echoandexit,
 						},
-						ContinueOnError: *fContinue,
+						Commands: map[string]Cmd{
+							"greet": {
+								Run: func(ts *TestScript, neg bool, args []string) {
+									fmt.Fprintf(ts.Stdout(), "hello %s\n", args[0])
+								},
+								Args:    "name [greeting]",
+								Summary: "Print a greeting.",
+							},
+						},
+						Conditions: map[string]Cond{
+							"always": {
+								Eval:    func(ts *TestScript, suffix string) (bool, error) { return true, nil },
+								Summary: "always true",
+							},
+							"is:": {
+								Eval:    func(ts *TestScript, suffix string) (bool, error) { return suffix == "yes", nil },
+								Args:    "word",
+								Summary: "whether word is yes",
+							},
+						},
+						ContinueOnError:       *fContinue,
+						FailOnLeakedProcesses: *fFailLeaked,
+						IsolatedHome:          *fIsolatedHome,
 					})
 				}()
 				stdout := t.log.String()
@@ -431,6 +583,174 @@ func TestUNIX2DOS(t *testing.T) {
 	}
 }
 
+func TestExecutablesCleanup(t *testing.T) {
+	// The directory holding the executables is removed by Cleanup,
+	// even when no scripts are run, as with -run.
+	tmp := t.TempDir()
+	t.Setenv("GOTMPDIR", tmp)
+	prog := filepath.Join(t.TempDir(), "prog")
+	if err := os.WriteFile(prog, nil, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	ft := &filterT{}
+	RunT(ft, Params{
+		Files:       []string{"script.txt"},
+		Executables: map[string]string{"prog": prog},
+	})
+	if entries, _ := os.ReadDir(tmp); len(entries) == 0 {
+		t.Fatal("executables not installed")
+	}
+	for _, f := range ft.cleanups {
+		f()
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("executables not removed: %v", entries)
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	p := &Params{
+		Commands: map[string]Cmd{
+			"greet": {Args: "name"},
+		},
+		Conditions: map[string]Cond{
+			"docker": {},
+		},
+		Cmds: map[string]func(ts *TestScript, neg bool, args []string){
+			"legacy": nil,
+		},
+	}
+	script := `# a comment
+exec echo hello
+stdout
+exsts foo
+! cp a b
+greet
+greet world
+[linux] [docker] [!exec:sh] exec true
+[nosuchcond] exec true
+[linux &&] exec true
+$GOEXE build
+if [windows || docker]
+	exec 'unterminated
+end
+retry 0 1s
+end
+! legacy arg
+`
+	want := []string{
+		"3: usage: stdout [-count=N] [-exact] pattern",
+		`4: unknown command "exsts" (did you mean "exists"?)`,
+		"5: unsupported: ! cp",
+		"6: usage: greet name",
+		`9: unknown condition "nosuchcond"`,
+		`10: bad condition "linux &&": unexpected end of condition`,
+		"13: unterminated quoted argument",
+		`15: invalid retry attempts "0": must be a positive integer`,
+	}
+	var got []string
+	for _, err := range p.CheckScript(script) {
+		got = append(got, err.Error())
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// Commands from Cmds are documented as they are checked.
+	if !p.AllCmds()["legacy"].Negatable {
+		t.Errorf("command from Cmds is not negatable in AllCmds")
+	}
+
+	// Block structure errors stop any further checking.
+	errs := p.CheckScript("exsts foo\nelse\n")
+	if len(errs) != 1 || errs[0].Error() != "2: else without matching if" {
+		t.Fatalf("unexpected errors for bad block: %v", errs)
+	}
+}
+
+func TestCheckScriptBuiltinConds(t *testing.T) {
+	// Every documented built-in condition is known to CheckScript.
+	// Conditions documented by a placeholder are checked with an
+	// example of the names they stand for.
+	examples := map[string]string{
+		"exec:":  "exec:sh",
+		"go1.x":  "go1.1",
+		"GOOS":   "linux",
+		"GOARCH": "amd64",
+	}
+	p := &Params{}
+	for name := range p.AllConds() {
+		cond := name
+		if ex, ok := examples[name]; ok {
+			cond = ex
+		}
+		if errs := p.CheckScript("[" + cond + "] exec true\n"); len(errs) != 0 {
+			t.Errorf("condition %q: %v", cond, errs)
+		}
+	}
+}
+
+func TestClosestLine(t *testing.T) {
+	for _, test := range []struct {
+		text, pattern string
+		want          string
+		wantOK        bool
+	}{
+		{"", "foo", "", false},
+		{"\n\n", "foo", "", false},
+		{"foo bar\n", "foo", "foo bar", true},
+		{"hello world\ngoodbye world\n", "goodby world", "goodbye world", true},
+		{"hello world\r\ngoodbye world\r\n", "helo", "hello world", true},
+		{"-count=3\nabc\n", "-count=2", "abc", true},
+	} {
+		got, ok := closestLine(test.text, test.pattern)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("closestLine(%q, %q) == %q, %v, want %q, %v", test.text, test.pattern, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestCoverReport(t *testing.T) {
+	out := []byte(`example.com/foo/main.go:10:	main		100.0%
+example.com/foo/main.go:20:	helper		0.0%
+example.com/foo/main.go:30:	other		50.0%
+total					(statements)	80.0%
+`)
+	all, covered := parseCovdataFunc(out)
+	if len(all) != 3 || len(covered) != 2 {
+		t.Fatalf("parseCovdataFunc returned %d functions, %d covered; want 3, 2", len(all), len(covered))
+	}
+	var buf bytes.Buffer
+	err := writeCoverReport(&buf, all, map[string][]coverFunc{
+		"b": covered[:1],
+		"a": covered,
+		"c": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Functions covered by each script:
+
+a
+	example.com/foo/main.go:10: main
+	example.com/foo/main.go:30: other
+
+b
+	example.com/foo/main.go:10: main
+
+c
+
+Scripts covering no function that other scripts do not:
+	b
+	c
+
+Functions not covered by any script:
+	example.com/foo/main.go:20: helper
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected report; got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
 func setSpecialVal(ts *TestScript, neg bool, args []string) {
 	ts.Setenv("SPECIALVAL", "42")
 }
@@ -479,6 +799,33 @@ func waitFile(ts *TestScript, neg bool, args []string) {
 	ts.Fatalf("timed out waiting for %q to be created", path)
 }
 
+// copyTestTree copies the directory tree src into the existing
+// directory dst, keeping the permissions of its files.
+func copyTestTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.Mkdir(target, 0o777)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
 type fakeT struct {
 	log     strings.Builder
 	verbose bool
@@ -519,6 +866,19 @@ func (t *fakeT) Verbose() bool {
 	return t.verbose
 }
 
+// filterT is a fakeT that supports Cleanup and runs none of the
+// scripts, as when they are all excluded by -run.
+type filterT struct {
+	fakeT
+	cleanups []func()
+}
+
+func (t *filterT) Run(name string, f func(T)) {}
+
+func (t *filterT) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
 type subT struct {
 	*fakeT
 	failed bool
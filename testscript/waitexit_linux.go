@@ -0,0 +1,20 @@
+package testscript
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitExited waits for p to exit without reaping it, so that its
+// process ID cannot be reused until p is waited for. It reports
+// whether it succeeded.
+func waitExited(p *os.Process) bool {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, p.Pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if err != unix.EINTR {
+			return err == nil
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package testscript
+
+import "os"
+
+// waitExited does nothing on platforms other than Linux, where
+// there is no portable way to wait for a process without reaping it.
+func waitExited(p *os.Process) bool {
+	return false
+}